@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultKeyEnv is the environment variable the key is read from, if it's not given any other way
+const DefaultKeyEnv = "EMISSARY_KEY"
+
+// profileFile names the emissary servers we can tunnel through, and what to forward through each of them. It can be
+// written as either YAML or JSON, such as:
+//
+//	profiles:
+//	  production:
+//	    url: wss://emissary.example.com
+//	    kid: 1
+//	    key_file: ~/.config/emissary/production.key
+//	    forwards:
+//	      - 5432:db.internal:5432
+//	      - 6379:redis.internal:6379
+type profileFile struct {
+	Profiles map[string]*profile `yaml:"profiles"`
+}
+
+// profile is an emissary server, the key to authenticate with it, and the ports to forward through it
+type profile struct {
+	URL       string   `yaml:"url"`
+	KeyID     uint     `yaml:"kid"`
+	KeyFile   string   `yaml:"key_file"` // a file containing the base64 encoded key
+	KeyEnv    string   `yaml:"key_env"`  // an environment variable containing the base64 encoded key
+	Forwards  []string `yaml:"forwards"` // ports to forward, as `[local_port:]host:port`
+	Proxy     string   `yaml:"proxy"`    // the protocols to run a local proxy with, if any
+	ProxyPort uint     `yaml:"proxy_port"`
+}
+
+// loadProfile reads the named profile from the file. If no name is given, the file must only contain one profile.
+func loadProfile(path, name string) (*profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read config file")
+	}
+
+	// YAML is a superset of JSON, so this reads either
+	var file profileFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, errors.Wrap(err, "unable to parse config file")
+	}
+
+	if name == "" {
+		if len(file.Profiles) != 1 {
+			return nil, errors.Newf("config file has %d profiles, so one must be picked using `-profile`", len(file.Profiles))
+		}
+		for _, p := range file.Profiles {
+			return p, nil
+		}
+	}
+
+	p, found := file.Profiles[name]
+	if !found || p == nil {
+		names := make([]string, 0, len(file.Profiles))
+		for name := range file.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, errors.Newf("profile %q not found in config file, expected one of: %s", name, strings.Join(names, ", "))
+	}
+	return p, nil
+}
+
+// readKey reads the base64 encoded key from the first place it was given; the command line, a file or an
+// environment variable
+func readKey(key, keyFile, keyEnv string) ([]byte, error) {
+	switch {
+	case key != "":
+	case keyFile != "":
+		data, err := os.ReadFile(expandHome(keyFile))
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read key file")
+		}
+		key = strings.TrimSpace(string(data))
+	default:
+		key = os.Getenv(keyEnv)
+		if key == "" {
+			return nil, errors.Newf("no key given with `-key`, `-key-file` or in $%s", keyEnv)
+		}
+	}
+
+	data, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to decode emissary key")
+	}
+	return data, nil
+}
+
+// expandHome replaces a leading `~` in the path with the user's home directory
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return home + path[1:]
+}
+
+// forward is a local port which is forwarded to a target through emissary
+type forward struct {
+	localPort uint // 0 will result in a random port
+	target    string
+}
+
+// parseForward parses a forward given as `[local_port:]host:port`
+func parseForward(s string) (forward, error) {
+	// A leading port is only the local port if a target follows it
+	if i := strings.Index(s, ":"); i > 0 {
+		if port, err := strconv.ParseUint(s[:i], 10, 16); err == nil {
+			if _, _, err := net.SplitHostPort(s[i+1:]); err == nil {
+				return forward{localPort: uint(port), target: s[i+1:]}, nil
+			}
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return forward{}, errors.Newf("invalid forward %q, expected [local_port:]host:port", s)
+	}
+	return forward{target: s}, nil
+}
+
+// forwardsFlag collects forwards from a flag which can be given many times
+type forwardsFlag []forward
+
+func (f *forwardsFlag) String() string {
+	forwards := make([]string, len(*f))
+	for i, fwd := range *f {
+		forwards[i] = strconv.Itoa(int(fwd.localPort)) + ":" + fwd.target
+	}
+	return strings.Join(forwards, ",")
+}
+
+func (f *forwardsFlag) Set(value string) error {
+	fwd, err := parseForward(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, fwd)
+	return nil
+}
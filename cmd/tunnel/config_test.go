@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseForward(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		value    string
+		expected forward
+		valid    bool
+	}{
+		{value: "db.internal:5432", expected: forward{target: "db.internal:5432"}, valid: true},
+		{value: "15432:db.internal:5432", expected: forward{localPort: 15432, target: "db.internal:5432"}, valid: true},
+		{value: "0:db.internal:5432", expected: forward{target: "db.internal:5432"}, valid: true},
+		{value: "10.0.0.1:80", expected: forward{target: "10.0.0.1:80"}, valid: true},
+		{value: "8080:10.0.0.1:80", expected: forward{localPort: 8080, target: "10.0.0.1:80"}, valid: true},
+		{value: "[::1]:443", expected: forward{target: "[::1]:443"}, valid: true},
+		{value: "8443:[::1]:443", expected: forward{localPort: 8443, target: "[::1]:443"}, valid: true},
+		{value: "70000:db.internal:5432", valid: false},
+		{value: "db.internal", valid: false},
+		{value: "1:2:3:4", valid: false},
+		{value: "", valid: false},
+	}
+
+	for _, test := range tests {
+		fwd, err := parseForward(test.value)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("expected forward %q to be invalid, got %+v", test.value, fwd)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unable to parse forward %q: %v", test.value, err)
+		} else if fwd != test.expected {
+			t.Errorf("expected forward %q to be %+v, got %+v", test.value, test.expected, fwd)
+		}
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	t.Parallel()
+
+	const twoProfiles = `
+profiles:
+  production:
+    url: wss://emissary.example.com
+    kid: 2
+    key_file: ~/.config/emissary/production.key
+    forwards:
+      - 5432:db.internal:5432
+  staging:
+    url: wss://emissary.staging.example.com
+    key_env: STAGING_KEY
+    proxy: socks5,http
+    proxy_port: 1080
+`
+
+	tests := []struct {
+		name     string
+		config   string
+		profile  string
+		expected *profile
+		err      string
+	}{
+		{
+			name:     "named profile",
+			config:   twoProfiles,
+			profile:  "production",
+			expected: &profile{URL: "wss://emissary.example.com", KeyID: 2, KeyFile: "~/.config/emissary/production.key", Forwards: []string{"5432:db.internal:5432"}},
+		},
+		{
+			name:     "proxy profile",
+			config:   twoProfiles,
+			profile:  "staging",
+			expected: &profile{URL: "wss://emissary.staging.example.com", KeyEnv: "STAGING_KEY", Proxy: "socks5,http", ProxyPort: 1080},
+		},
+		{
+			name:     "only profile",
+			config:   "profiles:\n  production:\n    url: wss://emissary.example.com\n",
+			expected: &profile{URL: "wss://emissary.example.com"},
+		},
+		{
+			name:     "json",
+			config:   `{"profiles": {"production": {"url": "wss://emissary.example.com", "kid": 2, "forwards": ["db.internal:5432"]}}}`,
+			profile:  "production",
+			expected: &profile{URL: "wss://emissary.example.com", KeyID: 2, Forwards: []string{"db.internal:5432"}},
+		},
+		{
+			name:   "profile must be picked",
+			config: twoProfiles,
+			err:    "config file has 2 profiles, so one must be picked using `-profile`",
+		},
+		{
+			name:    "unknown profile",
+			config:  twoProfiles,
+			profile: "development",
+			err:     `profile "development" not found in config file, expected one of: production, staging`,
+		},
+		{
+			name:    "unknown field",
+			config:  "profiles:\n  production:\n    url: wss://emissary.example.com\n    keyfile: production.key\n",
+			profile: "production",
+			err:     "field keyfile not found",
+		},
+		{
+			name:    "duplicate field",
+			config:  "profiles:\n  production:\n    url: wss://emissary.example.com\n    url: wss://emissary.staging.example.com\n",
+			profile: "production",
+			err:     "field url already set",
+		},
+		{
+			name:    "wrong type",
+			config:  "profiles:\n  production:\n    kid: one\n",
+			profile: "production",
+			err:     "unable to parse config file",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "emissary.yaml")
+			if err := os.WriteFile(path, []byte(test.config), 0o600); err != nil {
+				t.Fatalf("unable to write config file: %v", err)
+			}
+
+			p, err := loadProfile(path, test.profile)
+			switch {
+			case test.err != "":
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+			case err != nil:
+				t.Fatalf("unable to load profile: %v", err)
+			case !reflect.DeepEqual(p, test.expected):
+				t.Fatalf("expected profile %+v, got %+v", test.expected, p)
+			}
+		})
+	}
+}
+
+// TestReadKey checks the key is read from the flag, then the file, then the environment variable
+func TestReadKey(t *testing.T) {
+	encode := func(key string) string {
+		return base64.StdEncoding.EncodeToString([]byte(key))
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "emissary.key")
+	if err := os.WriteFile(keyFile, []byte(encode("from file")+"\n"), 0o600); err != nil {
+		t.Fatalf("unable to write key file: %v", err)
+	}
+	t.Setenv("EMISSARY_TEST_KEY", encode("from env"))
+	t.Setenv("EMISSARY_TEST_INVALID_KEY", "not base64!")
+
+	tests := []struct {
+		name     string
+		key      string
+		keyFile  string
+		keyEnv   string
+		expected string
+		err      string
+	}{
+		{name: "flag", key: encode("from flag"), keyFile: keyFile, keyEnv: "EMISSARY_TEST_KEY", expected: "from flag"},
+		{name: "file", keyFile: keyFile, keyEnv: "EMISSARY_TEST_KEY", expected: "from file"},
+		{name: "env", keyEnv: "EMISSARY_TEST_KEY", expected: "from env"},
+		{name: "missing file", keyFile: keyFile + ".missing", keyEnv: "EMISSARY_TEST_KEY", err: "unable to read key file"},
+		{name: "missing env", keyEnv: "EMISSARY_TEST_UNSET_KEY", err: "no key given with `-key`, `-key-file` or in $EMISSARY_TEST_UNSET_KEY"},
+		{name: "invalid key", keyEnv: "EMISSARY_TEST_INVALID_KEY", err: "unable to decode emissary key"},
+	}
+
+	for _, test := range tests {
+		key, err := readKey(test.key, test.keyFile, test.keyEnv)
+		switch {
+		case test.err != "":
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error containing %q, got %v", test.name, test.err, err)
+			}
+		case err != nil:
+			t.Errorf("%s: unable to read key: %v", test.name, err)
+		case string(key) != test.expected:
+			t.Errorf("%s: expected key %q, got %q", test.name, test.expected, key)
+		}
+	}
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
-	"encoding/base64"
 	"flag"
 	"fmt"
-	"io"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -20,13 +21,77 @@ func main() {
 	).With().Caller().Timestamp().Logger()
 
 	// Read input
-	host := flag.String("url", "", "URL to the emissary server")
+	configFile := flag.String("config", "", "A YAML or JSON file of profiles naming emissary servers and the ports to forward through them")
+	profileName := flag.String("profile", "", "The profile to use from the `-config` file, which can be left out if it only has one")
+	host := flag.String("url", "", "URL to the emissary server (ws://, wss://, tcp:// or tls://)")
 	keyID := flag.Uint("kid", 1, "The emissary key ID")
-	key := flag.String("key", "", "The emissary key base64 encoded")
+	key := flag.String("key", "", "The emissary key base64 encoded; prefer `-key-file` or `-key-env`, as this is visible to other processes")
+	keyFile := flag.String("key-file", "", "A file containing the emissary key base64 encoded")
+	keyEnv := flag.String("key-env", DefaultKeyEnv, "An environment variable containing the emissary key base64 encoded")
 	target := flag.String("target", "", "The target host:port you want to connect to via emissary")
+	proxyProtocols := flag.String("proxy", "", "Instead of a single -target, run a local proxy to any allowed target; socks5, http (CONNECT) or socks5,http")
 	listenPort := flag.Uint("port", 0, "Port that the tunnel will listen on for your local system (0 will result in a random port)")
+	retryTimeout := flag.Duration("retry-timeout", time.Minute, "How long to keep retrying to reach the emissary server for each connection")
+	statusInterval := flag.Duration("status-interval", 5*time.Minute, "How often to log a summary of the active connections (0 to disable)")
+	var forwards forwardsFlag
+	flag.Var(&forwards, "forward", "A target to forward a local port to, as `[local_port:]host:port`, which can be given many times")
 	flag.Parse()
 
+	if *target != "" && *proxyProtocols != "" {
+		flag.PrintDefaults()
+		log.Fatal().Msg("only one of `-target` or `-proxy` can be given")
+		os.Exit(1)
+	}
+	if *target != "" {
+		forwards = append(forwards, forward{localPort: *listenPort, target: *target})
+	}
+
+	// Anything not given on the command line is taken from the profile
+	proxyPort := *listenPort
+	if *configFile != "" {
+		p, err := loadProfile(expandHome(*configFile), *profileName)
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to load profile")
+			os.Exit(1)
+		}
+
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if !set["url"] {
+			*host = p.URL
+		}
+		if !set["kid"] && p.KeyID != 0 {
+			*keyID = p.KeyID
+		}
+		if !set["key"] && !set["key-file"] && !set["key-env"] {
+			*keyFile = p.KeyFile
+			if p.KeyEnv != "" {
+				*keyEnv = p.KeyEnv
+			}
+		}
+		if !set["proxy"] {
+			*proxyProtocols = p.Proxy
+		}
+		if !set["port"] {
+			proxyPort = p.ProxyPort
+		}
+		for _, f := range p.Forwards {
+			fwd, err := parseForward(f)
+			if err != nil {
+				log.Fatal().Err(err).Msg("invalid forward in profile")
+				os.Exit(1)
+			}
+			forwards = append(forwards, fwd)
+		}
+
+		// The profile's proxy can't be combined with -target either, as -port would be for both of them
+		if *target != "" && *proxyProtocols != "" {
+			flag.PrintDefaults()
+			log.Fatal().Msg("only one of `-target` or the profile's `proxy` can be given")
+			os.Exit(1)
+		}
+	}
+
 	if host == nil || *host == "" {
 		flag.PrintDefaults()
 		log.Fatal().Msg("expected a emissary server url to be passed in using `-url`")
@@ -39,71 +104,92 @@ func main() {
 		os.Exit(1)
 	}
 
-	if key == nil || *key == "" {
+	if len(forwards) == 0 && *proxyProtocols == "" {
 		flag.PrintDefaults()
-		log.Fatal().Msg("expected a base64 encoded key passed in using `-key`")
+		log.Fatal().Msg("expected a target to be passed in using `-target` or `-forward`, or a proxy protocol using `-proxy`")
 		os.Exit(1)
 	}
 
-	if target == nil || *target == "" {
+	data, err := readKey(*key, *keyFile, *keyEnv)
+	if err != nil {
 		flag.PrintDefaults()
-		log.Fatal().Msg("expected a target to be passed in using `-target`")
+		log.Fatal().Err(err).Msg("unable to read emissary key")
 		os.Exit(1)
 	}
-
-	data, err := base64.StdEncoding.DecodeString(*key)
-	if err != nil {
-		log.Fatal().Err(err).Msg("unable to decode emissary key")
-		os.Exit(1)
+	if *key != "" {
+		log.Warn().Msg("the key passed with `-key` can be seen in your shell history and by other processes, consider using `-key-file` or `-key-env` instead")
 	}
 
-	// Start listening for connections
-	l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", *listenPort))
+	// Setup the dialer, which is shared between all connections so they can be multiplexed over the same session
+	dialer, err := emissary.NewDialer(*host, auth.Key{KeyID: uint32(*keyID), Data: data})
 	if err != nil {
-		log.Fatal().Err(err).Msg("unable to start listening locally")
+		log.Fatal().Err(err).Msg("unable to create emissary dialer")
 		os.Exit(1)
 	}
-	defer func() { _ = l.Close() }()
+	defer func() { _ = dialer.Close() }()
+	t := newTunnel(dialer, *retryTimeout)
 
-	log.Info().Msgf("Will tunnel traffic to %s", *target)
-	log.Info().Msgf("Please connect to: %s", l.Addr().String())
+	// Start listening for connections on every port before we accept any, so a port which is in use fails fast
+	listeners := make([]net.Listener, len(forwards))
+	for i, fwd := range forwards {
+		listeners[i] = mustListen(fwd.localPort)
+		defer func(l net.Listener) { _ = l.Close() }(listeners[i])
 
-	for {
-		// Wait for connections
-		local, err := l.Accept()
+		log.Info().Msgf("Will tunnel traffic to %s", fwd.target)
+		log.Info().Msgf("Please connect to: %s", listeners[i].Addr().String())
+	}
+
+	// In proxy mode, each connection says which target it wants to be tunnelled to
+	var proxyListener net.Listener
+	var forwardProxy *localProxy
+	if *proxyProtocols != "" {
+		forwardProxy, err = newLocalProxy(t, *proxyProtocols)
 		if err != nil {
-			log.Fatal().Err(err).Msg("unable to accept connection")
+			log.Fatal().Err(err).Msg("invalid `-proxy`")
 			os.Exit(1)
 		}
-		log.Info().Msgf("accepted connection from %s", local.RemoteAddr().String())
+		proxyListener = mustListen(proxyPort)
+		defer func() { _ = proxyListener.Close() }()
 
-		go func() {
-			// Setup the dialer
-			log.Info().Msgf("dialing emissary server at %s", *host)
-			dialer := emissary.NewWebsocketDialer(*host, auth.Key{KeyID: uint32(*keyID), Data: data})
+		log.Info().Msgf("Will proxy traffic to any allowed target using %s", *proxyProtocols)
+		log.Info().Msgf("Please configure your proxy as: %s", proxyListener.Addr().String())
+	}
 
-			remote, err := dialer.Dial("tcp", *target)
-			if err != nil {
-				log.Fatal().Err(err).Msg("unable to dial target through emissary")
-				os.Exit(1)
-			}
+	for i, fwd := range forwards {
+		target := fwd.target
+		go t.serve(listeners[i], func(local net.Conn) { t.forward(local, target) })
+	}
+	if forwardProxy != nil {
+		go t.serve(proxyListener, forwardProxy.serve)
+	}
 
-			// Proxy traffic
-			errs := make(chan error, 2)
-			go proxy(local, remote, errs)
-			go proxy(remote, local, errs)
-			for i := 0; i < 2; i++ {
-				e := <-errs
-				if e != nil {
-					log.Fatal().Err(err).Msg("error while proxying traffic through the tunnel")
-					os.Exit(1)
-				}
-			}
-		}()
+	// Run until we're told to stop, logging which connections are open every so often and as we stop
+	var status <-chan time.Time
+	if *statusInterval > 0 {
+		ticker := time.NewTicker(*statusInterval)
+		defer ticker.Stop()
+		status = ticker.C
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	for {
+		select {
+		case <-status:
+			t.summarise()
+		case <-stop:
+			log.Info().Msg("shutting down tunnel")
+			t.summarise()
+			return
+		}
 	}
 }
 
-func proxy(from, to net.Conn, errs chan error) {
-	_, err := io.Copy(to, from)
-	errs <- err
+// mustListen starts listening for connections on the local port
+func mustListen(port uint) net.Listener {
+	l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to start listening locally")
+		os.Exit(1)
+	}
+	return l
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/rs/zerolog/log"
+	"go.encore.dev/emissary"
+)
+
+// The protocols the local proxy can speak
+const (
+	proxySOCKS5 = "socks5"
+	proxyHTTP   = "http"
+)
+
+// The parts of SOCKS5 the local proxy speaks; only the CONNECT command without authentication is supported
+const (
+	socks5Version         = 0x05
+	socks5NoAuth          = 0x00
+	socks5NoAcceptable    = 0xFF
+	socks5Connect         = 0x01
+	socks5AddrIPv4        = 0x01
+	socks5AddrDomain      = 0x03
+	socks5AddrIPv6        = 0x04
+	socks5Succeeded       = 0x00
+	socks5Failure         = 0x01
+	socks5NotAllowed      = 0x02
+	socks5HostUnreachable = 0x04
+	socks5CmdUnsupported  = 0x07
+	socks5AddrUnsupported = 0x08
+)
+
+// localProxy is a SOCKS5 and/or HTTP CONNECT proxy which tunnels each connection through emissary to the
+// destination the client asks for
+type localProxy struct {
+	tunnel *tunnel
+	socks5 bool
+	http   bool
+}
+
+// newLocalProxy creates a proxy speaking the comma separated list of protocols
+func newLocalProxy(t *tunnel, protocols string) (*localProxy, error) {
+	p := &localProxy{tunnel: t}
+	for _, protocol := range strings.Split(protocols, ",") {
+		switch strings.TrimSpace(protocol) {
+		case proxySOCKS5:
+			p.socks5 = true
+		case proxyHTTP:
+			p.http = true
+		default:
+			return nil, errors.Newf("unknown proxy protocol %q, expected %s or %s", protocol, proxySOCKS5, proxyHTTP)
+		}
+	}
+	return p, nil
+}
+
+// serve handles a connection to the local proxy, working out which protocol the client is speaking from the first
+// byte it sends, as SOCKS5 always starts with its version and HTTP with a method name
+func (p *localProxy) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	local := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	first, err := local.r.Peek(1)
+	if err != nil {
+		log.Warn().Err(err).Msgf("unable to read from %s", conn.RemoteAddr())
+		return
+	}
+
+	var remote net.Conn
+	var target string
+	switch {
+	case first[0] == socks5Version && p.socks5:
+		remote, target, err = p.serveSOCKS5(local)
+	case first[0] != socks5Version && p.http:
+		remote, target, err = p.serveHTTPConnect(local)
+	default:
+		err = errors.New("unsupported proxy protocol")
+	}
+	if err != nil {
+		log.Warn().Err(err).Msgf("unable to proxy connection from %s", conn.RemoteAddr())
+		return
+	}
+	defer func() { _ = remote.Close() }()
+
+	p.tunnel.relay(local, remote, target)
+}
+
+// serveSOCKS5 runs the SOCKS5 handshake with the client, returning the connection to the target it asked for
+func (p *localProxy) serveSOCKS5(conn *bufferedConn) (remote net.Conn, target string, err error) {
+	// The client greets us with the authentication methods it supports
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, "", errors.Wrap(err, "unable to read socks5 greeting")
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, "", errors.Wrap(err, "unable to read socks5 auth methods")
+	}
+	if !strings.ContainsRune(string(methods), socks5NoAuth) {
+		_, _ = conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return nil, "", errors.New("socks5 client does not support connecting without authentication")
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5NoAuth}); err != nil {
+		return nil, "", errors.Wrap(err, "unable to write socks5 auth method")
+	}
+
+	// Then sends its request
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil, "", errors.Wrap(err, "unable to read socks5 request")
+	}
+	if request[1] != socks5Connect {
+		_ = writeSOCKS5Reply(conn, socks5CmdUnsupported)
+		return nil, "", errors.Newf("unsupported socks5 command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, "", errors.Wrap(err, "unable to read socks5 destination")
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		length := []byte{0}
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, "", errors.Wrap(err, "unable to read socks5 destination")
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return nil, "", errors.Wrap(err, "unable to read socks5 destination")
+		}
+		host = string(domain)
+	default:
+		_ = writeSOCKS5Reply(conn, socks5AddrUnsupported)
+		return nil, "", errors.Newf("unsupported socks5 address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, "", errors.Wrap(err, "unable to read socks5 destination port")
+	}
+
+	// Hostnames are passed through to the emissary server to be resolved within the private network
+	target = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	remote, err = p.tunnel.dial(conn, target)
+	if err != nil {
+		reply := byte(socks5Failure)
+		switch {
+		case errors.Is(err, emissary.ErrTargetNotAllowed):
+			reply = socks5NotAllowed
+		case errors.Is(err, emissary.ErrTargetUnreachable):
+			reply = socks5HostUnreachable
+		}
+		_ = writeSOCKS5Reply(conn, reply)
+		return nil, "", err
+	}
+
+	if err := writeSOCKS5Reply(conn, socks5Succeeded); err != nil {
+		_ = remote.Close()
+		return nil, "", err
+	}
+	return remote, target, nil
+}
+
+// writeSOCKS5Reply replies to the client's SOCKS5 request. We don't know the address the emissary server dialed
+// from, so always reply with an empty bind address
+func writeSOCKS5Reply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socks5Version, reply, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return errors.Wrap(err, "unable to write socks5 reply")
+}
+
+// serveHTTPConnect reads the client's HTTP CONNECT request, returning the connection to the target it asked for
+func (p *localProxy) serveHTTPConnect(conn *bufferedConn) (remote net.Conn, target string, err error) {
+	req, err := http.ReadRequest(conn.r)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "unable to read http request")
+	}
+	_ = req.Body.Close()
+	if req.Method != http.MethodConnect {
+		_ = writeHTTPResponse(conn, http.StatusMethodNotAllowed, "only CONNECT requests are supported\n")
+		return nil, "", errors.Newf("unsupported http method %s", req.Method)
+	}
+
+	target = req.Host
+	remote, err = p.tunnel.dial(conn, target)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, emissary.ErrTargetNotAllowed) {
+			status = http.StatusForbidden
+		}
+		_ = writeHTTPResponse(conn, status, err.Error()+"\n")
+		return nil, "", err
+	}
+
+	if _, err := fmt.Fprintf(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		_ = remote.Close()
+		return nil, "", errors.Wrap(err, "unable to write http response")
+	}
+	return remote, target, nil
+}
+
+func writeHTTPResponse(conn net.Conn, status int, body string) error {
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		status, http.StatusText(status), len(body), body)
+	return errors.Wrap(err, "unable to write http response")
+}
+
+// bufferedConn reads from the buffer used to work out which protocol the client is speaking, before the connection
+// itself, so the bytes peeked at aren't lost
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p) //nolint:wrapcheck
+}
+
+// CloseWrite half closes the underlying connection if it supports it, otherwise it is closed completely.
+func (b *bufferedConn) CloseWrite() error {
+	if closer, ok := b.Conn.(interface{ CloseWrite() error }); ok {
+		return errors.Wrap(closer.CloseWrite(), "unable to close write")
+	}
+	return b.Conn.Close() //nolint:wrapcheck
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"go.encore.dev/emissary"
+)
+
+func TestLocalProxy_SOCKS5(t *testing.T) {
+	t.Parallel()
+
+	greeting := []byte{socks5Version, 1, socks5NoAuth}
+	accepted := []byte{socks5Version, socks5NoAuth}
+	reply := func(code byte) []byte {
+		return []byte{socks5Version, code, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	tests := []struct {
+		name    string
+		request []byte
+		dialErr error
+		reply   []byte
+		target  string
+		err     string
+	}{
+		{
+			name:    "domain",
+			request: join(greeting, []byte{socks5Version, socks5Connect, 0x00, socks5AddrDomain, 11}, []byte("db.internal"), []byte{0x15, 0x38}),
+			reply:   join(accepted, reply(socks5Succeeded)),
+			target:  "db.internal:5432",
+		},
+		{
+			name:    "ipv4",
+			request: join(greeting, []byte{socks5Version, socks5Connect, 0x00, socks5AddrIPv4, 10, 0, 0, 1, 0x00, 0x50}),
+			reply:   join(accepted, reply(socks5Succeeded)),
+			target:  "10.0.0.1:80",
+		},
+		{
+			name:    "ipv6",
+			request: join(greeting, []byte{socks5Version, socks5Connect, 0x00, socks5AddrIPv6}, net.IPv6loopback, []byte{0x01, 0xBB}),
+			reply:   join(accepted, reply(socks5Succeeded)),
+			target:  "[::1]:443",
+		},
+		{
+			name:    "no auth among many methods",
+			request: join([]byte{socks5Version, 3, 0x02, 0x01, socks5NoAuth}, []byte{socks5Version, socks5Connect, 0x00, socks5AddrIPv4, 10, 0, 0, 1, 0x00, 0x50}),
+			reply:   join(accepted, reply(socks5Succeeded)),
+			target:  "10.0.0.1:80",
+		},
+		{
+			name:    "auth required",
+			request: []byte{socks5Version, 1, 0x02},
+			reply:   []byte{socks5Version, socks5NoAcceptable},
+			err:     "socks5 client does not support connecting without authentication",
+		},
+		{
+			name:    "bind command",
+			request: join(greeting, []byte{socks5Version, 0x02, 0x00, socks5AddrIPv4, 10, 0, 0, 1, 0x00, 0x50}),
+			reply:   join(accepted, reply(socks5CmdUnsupported)),
+			err:     "unsupported socks5 command 2",
+		},
+		{
+			name:    "unknown address type",
+			request: join(greeting, []byte{socks5Version, socks5Connect, 0x00, 0x09}),
+			reply:   join(accepted, reply(socks5AddrUnsupported)),
+			err:     "unsupported socks5 address type 9",
+		},
+		{
+			name:    "truncated greeting",
+			request: []byte{socks5Version, 2, socks5NoAuth},
+			err:     "unable to read socks5 auth methods",
+		},
+		{
+			name:    "truncated request",
+			request: join(greeting, []byte{socks5Version, socks5Connect}),
+			reply:   accepted,
+			err:     "unable to read socks5 request",
+		},
+		{
+			name:    "truncated destination",
+			request: join(greeting, []byte{socks5Version, socks5Connect, 0x00, socks5AddrDomain, 11}, []byte("db")),
+			reply:   accepted,
+			err:     "unable to read socks5 destination",
+		},
+		{
+			name:    "target not allowed",
+			request: join(greeting, []byte{socks5Version, socks5Connect, 0x00, socks5AddrIPv4, 10, 0, 0, 1, 0x00, 0x50}),
+			dialErr: emissary.ErrTargetNotAllowed,
+			reply:   join(accepted, reply(socks5NotAllowed)),
+			err:     emissary.ErrTargetNotAllowed.Error(),
+		},
+		{
+			name:    "target unreachable",
+			request: join(greeting, []byte{socks5Version, socks5Connect, 0x00, socks5AddrIPv4, 10, 0, 0, 1, 0x00, 0x50}),
+			dialErr: emissary.ErrTargetUnreachable,
+			reply:   join(accepted, reply(socks5HostUnreachable)),
+			err:     emissary.ErrTargetUnreachable.Error(),
+		},
+		{
+			name:    "server unreachable",
+			request: join(greeting, []byte{socks5Version, socks5Connect, 0x00, socks5AddrIPv4, 10, 0, 0, 1, 0x00, 0x50}),
+			dialErr: errors.New("connection refused"),
+			reply:   join(accepted, reply(socks5Failure)),
+			err:     "unable to reach emissary server",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			dialer := &fakeDialer{errs: []error{test.dialErr}}
+			p := &localProxy{tunnel: newTunnel(dialer, 0), socks5: true}
+			reply, target, err := serveLocal(test.request, test.target != "" || test.dialErr != nil, p.serveSOCKS5)
+
+			if !bytes.Equal(reply, test.reply) {
+				t.Errorf("expected reply %v, got %v", test.reply, reply)
+			}
+			checkServed(t, target, err, test.target, test.err)
+		})
+	}
+}
+
+func TestLocalProxy_HTTPConnect(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		request string
+		dialErr error
+		reply   string // the start of the reply
+		target  string
+		err     string
+	}{
+		{
+			name:    "connect",
+			request: "CONNECT db.internal:5432 HTTP/1.1\r\nHost: db.internal:5432\r\n\r\n",
+			reply:   "HTTP/1.1 200 Connection established\r\n\r\n",
+			target:  "db.internal:5432",
+		},
+		{
+			name:    "connect ipv6",
+			request: "CONNECT [::1]:443 HTTP/1.1\r\nHost: [::1]:443\r\n\r\n",
+			reply:   "HTTP/1.1 200 Connection established\r\n\r\n",
+			target:  "[::1]:443",
+		},
+		{
+			name:    "other methods",
+			request: "GET http://db.internal/ HTTP/1.1\r\nHost: db.internal\r\n\r\n",
+			reply:   "HTTP/1.1 405 Method Not Allowed\r\n",
+			err:     "unsupported http method GET",
+		},
+		{
+			name:    "malformed request",
+			request: "not http\r\n\r\n",
+			err:     "unable to read http request",
+		},
+		{
+			name:    "target not allowed",
+			request: "CONNECT db.internal:5432 HTTP/1.1\r\nHost: db.internal:5432\r\n\r\n",
+			dialErr: emissary.ErrTargetNotAllowed,
+			reply:   "HTTP/1.1 403 Forbidden\r\n",
+			err:     emissary.ErrTargetNotAllowed.Error(),
+		},
+		{
+			name:    "server unreachable",
+			request: "CONNECT db.internal:5432 HTTP/1.1\r\nHost: db.internal:5432\r\n\r\n",
+			dialErr: errors.New("connection refused"),
+			reply:   "HTTP/1.1 502 Bad Gateway\r\n",
+			err:     "unable to reach emissary server",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			dialer := &fakeDialer{errs: []error{test.dialErr}}
+			p := &localProxy{tunnel: newTunnel(dialer, 0), http: true}
+			reply, target, err := serveLocal([]byte(test.request), test.target != "" || test.dialErr != nil, p.serveHTTPConnect)
+
+			if !strings.HasPrefix(string(reply), test.reply) || (test.reply == "" && len(reply) > 0) {
+				t.Errorf("expected reply starting %q, got %q", test.reply, reply)
+			}
+			checkServed(t, target, err, test.target, test.err)
+		})
+	}
+}
+
+// serveLocal runs the proxy handshake against a client which sends the request and nothing more, returning everything
+// the proxy replied with along with what the handshake returned. If the client waits, it stays connected once it's sent
+// the request, as it would waiting for the reply, otherwise it hangs up.
+func serveLocal(request []byte, wait bool, serve func(conn *bufferedConn) (net.Conn, string, error)) ([]byte, string, error) {
+	client := &scriptedConn{request: bytes.NewReader(request), wait: wait, deadline: make(chan struct{})}
+	remote, target, err := serve(&bufferedConn{Conn: client, r: bufio.NewReader(client)})
+	if remote != nil {
+		_ = remote.Close()
+	}
+	return client.reply.Bytes(), target, err
+}
+
+// scriptedConn is a local client which sends the request, and then either waits or reaches EOF, recording what it's
+// sent in reply
+type scriptedConn struct {
+	net.Conn     // only there to satisfy the interface
+	request      io.Reader
+	wait         bool          // if reads block once the request has been read, until a read deadline is set
+	deadline     chan struct{} // closed once a read deadline is set
+	deadlineOnce sync.Once
+	reply        bytes.Buffer
+}
+
+func (c *scriptedConn) Read(p []byte) (int, error) {
+	n, err := c.request.Read(p)
+	if errors.Is(err, io.EOF) && c.wait {
+		<-c.deadline
+		return 0, os.ErrDeadlineExceeded
+	}
+	return n, err //nolint:wrapcheck
+}
+
+func (c *scriptedConn) Write(p []byte) (int, error) {
+	return c.reply.Write(p) //nolint:wrapcheck
+}
+
+func (c *scriptedConn) SetReadDeadline(t time.Time) error {
+	if !t.IsZero() {
+		c.deadlineOnce.Do(func() { close(c.deadline) })
+	}
+	return nil
+}
+
+// checkServed checks the handshake returned the target, or the error
+func checkServed(t *testing.T, target string, err error, expectedTarget, expectedErr string) {
+	t.Helper()
+
+	switch {
+	case expectedErr == "" && err != nil:
+		t.Fatalf("unexpected error: %v", err)
+	case expectedErr != "" && (err == nil || !strings.Contains(err.Error(), expectedErr)):
+		t.Fatalf("expected error containing %q, got %v", expectedErr, err)
+	case target != expectedTarget:
+		t.Fatalf("expected target %q, got %q", expectedTarget, target)
+	}
+}
+
+// fakeDialer stands in for the emissary dialer, recording the targets dialled and failing with each of errs in turn
+// until they run out. Successful dials return a pipe with nothing on the other end.
+type fakeDialer struct {
+	mu      sync.Mutex
+	errs    []error
+	dialled []string
+}
+
+func (d *fakeDialer) DialContext(_ context.Context, _, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.dialled = append(d.dialled, addr)
+	if len(d.errs) > 0 {
+		err := d.errs[0]
+		d.errs = d.errs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	local, remote := net.Pipe()
+	_ = remote.Close()
+	return local, nil
+}
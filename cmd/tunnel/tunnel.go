@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/rs/zerolog/log"
+	"go.encore.dev/emissary"
+	"golang.org/x/net/proxy"
+)
+
+// The backoff between attempts to reach the emissary server when dialing a target
+const (
+	initialDialBackoff = 250 * time.Millisecond
+	maxDialBackoff     = 10 * time.Second
+)
+
+// The backoff between attempts to accept a local connection, after accepting fails
+const (
+	initialAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff     = time.Second
+)
+
+// tunnel tunnels the connections accepted locally through emissary, keeping track of those which are active.
+//
+// Each connection is independent of the others, so a failure while tunnelling one of them never affects the rest.
+type tunnel struct {
+	dialer       proxy.ContextDialer // the emissary dialer, shared by every connection
+	retryTimeout time.Duration       // how long to keep retrying to reach the emissary server for a connection
+
+	mu     sync.Mutex
+	nextID uint64
+	active map[uint64]*activeConn
+}
+
+// activeConn is a connection which is currently being tunnelled
+type activeConn struct {
+	bytesIn  int64 // accessed atomically, so kept first for alignment
+	bytesOut int64
+	id       uint64
+	from     string
+	target   string
+	start    time.Time
+}
+
+func newTunnel(dialer proxy.ContextDialer, retryTimeout time.Duration) *tunnel {
+	return &tunnel{
+		dialer:       dialer,
+		retryTimeout: retryTimeout,
+		active:       make(map[uint64]*activeConn),
+	}
+}
+
+// serve accepts connections on the listener until it's closed, handling each of them in a new goroutine
+func (t *tunnel) serve(l net.Listener, handle func(local net.Conn)) {
+	backoff := initialAcceptBackoff
+	for {
+		// Wait for connections
+		local, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Warn().Err(err).Msgf("unable to accept connection, retrying in %s", backoff)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxAcceptBackoff {
+				backoff = maxAcceptBackoff
+			}
+			continue
+		}
+		backoff = initialAcceptBackoff
+		log.Info().Msgf("accepted connection from %s", local.RemoteAddr().String())
+
+		go handle(local)
+	}
+}
+
+// forward tunnels the local connection to the target
+func (t *tunnel) forward(conn net.Conn, target string) {
+	defer func() { _ = conn.Close() }()
+
+	local := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	remote, err := t.dial(local, target)
+	if err != nil {
+		log.Warn().Err(err).Msgf("unable to tunnel connection from %s", local.RemoteAddr())
+		return
+	}
+	defer func() { _ = remote.Close() }()
+
+	t.relay(local, remote, target)
+}
+
+// dial connects to the target through emissary for the local client, giving up if the client hangs up first.
+func (t *tunnel) dial(local *bufferedConn, target string) (net.Conn, error) {
+	ctx, stop := watchLocal(local)
+	defer stop()
+
+	return t.dialContext(ctx, target)
+}
+
+// watchLocal returns a context which is cancelled if the local client hangs up, such as while we're retrying to reach
+// the emissary server for it. Nothing else may read from the connection until stop is called.
+//
+// Whatever the client sends is left buffered for the relay, but a client which half closes before sending anything
+// can't be told apart from one which has hung up.
+func watchLocal(local *bufferedConn) (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := local.r.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel()
+		}
+	}()
+
+	return ctx, func() {
+		// Interrupt the peek, then let reads block again
+		_ = local.SetReadDeadline(time.Now())
+		<-done
+		_ = local.SetReadDeadline(time.Time{})
+		cancel()
+	}
+}
+
+// dialContext connects to the target through emissary. If the emissary server can't be reached, we retry with an
+// exponential backoff until the retry timeout or the context is done, but if the server rejects the connection we
+// give up straight away.
+func (t *tunnel) dialContext(ctx context.Context, target string) (net.Conn, error) {
+	deadline := time.Now().Add(t.retryTimeout)
+	backoff := initialDialBackoff
+	for {
+		log.Info().Msgf("dialing %s through emissary", target)
+		remote, err := t.dialer.DialContext(ctx, "tcp", target)
+		if err == nil {
+			return remote, nil
+		}
+		if ctx.Err() != nil {
+			return nil, errors.Wrapf(ctx.Err(), "local client hung up while dialing %s", target)
+		}
+		if rejected(err) {
+			return nil, errors.Wrapf(err, "emissary server rejected connection to %s", target)
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, errors.Wrapf(err, "unable to reach emissary server, gave up after %s", t.retryTimeout)
+		}
+
+		log.Warn().Err(err).Msgf("unable to reach emissary server, retrying in %s", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "local client hung up while dialing %s", target)
+		}
+		if backoff *= 2; backoff > maxDialBackoff {
+			backoff = maxDialBackoff
+		}
+	}
+}
+
+// rejected reports if the error is the emissary server rejecting a connection, which retrying will not fix
+func rejected(err error) bool {
+	for _, reason := range []error{
+		emissary.ErrUnauthorized,
+		emissary.ErrUnknownKeyID,
+		emissary.ErrClockSkew,
+		emissary.ErrTargetNotAllowed,
+		emissary.ErrTargetUnreachable,
+		emissary.ErrProtocolVersion,
+	} {
+		if errors.Is(err, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// relay copies data in both directions between the local connection and the target, half closing each side once
+// the other has finished sending, until both directions are done
+func (t *tunnel) relay(local, remote net.Conn, target string) {
+	conn := t.track(local.RemoteAddr().String(), target)
+	defer t.untrack(conn)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if _, err := io.Copy(&countingWriter{Writer: remote, n: &conn.bytesOut}, local); err != nil {
+			log.Debug().Err(err).Uint64("id", conn.id).Msg("error while sending traffic through the tunnel")
+		}
+		closeWrite(remote)
+	}()
+	go func() {
+		defer wg.Done()
+		if _, err := io.Copy(&countingWriter{Writer: local, n: &conn.bytesIn}, remote); err != nil {
+			log.Debug().Err(err).Uint64("id", conn.id).Msg("error while receiving traffic through the tunnel")
+		}
+		closeWrite(local)
+	}()
+	wg.Wait()
+}
+
+// closeWrite half closes the connection if it supports it, otherwise it is closed completely
+func closeWrite(conn net.Conn) {
+	if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = closer.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
+
+func (t *tunnel) track(from, target string) *activeConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextID++
+	conn := &activeConn{id: t.nextID, from: from, target: target, start: time.Now()}
+	t.active[conn.id] = conn
+	return conn
+}
+
+func (t *tunnel) untrack(conn *activeConn) {
+	t.mu.Lock()
+	delete(t.active, conn.id)
+	t.mu.Unlock()
+
+	log.Info().Uint64("id", conn.id).Str("from", conn.from).Str("target", conn.target).
+		Dur("duration", time.Since(conn.start).Round(time.Millisecond)).
+		Int64("bytes_in", atomic.LoadInt64(&conn.bytesIn)).Int64("bytes_out", atomic.LoadInt64(&conn.bytesOut)).
+		Msg("connection closed")
+}
+
+// summarise logs the connections which are currently active
+func (t *tunnel) summarise() {
+	t.mu.Lock()
+	active := make([]*activeConn, 0, len(t.active))
+	for _, conn := range t.active {
+		active = append(active, conn)
+	}
+	t.mu.Unlock()
+	sort.Slice(active, func(i, j int) bool { return active[i].id < active[j].id })
+
+	log.Info().Int("active", len(active)).Msg("active connections")
+	for _, conn := range active {
+		log.Info().Uint64("id", conn.id).Str("from", conn.from).Str("target", conn.target).
+			Dur("open_for", time.Since(conn.start).Round(time.Second)).
+			Int64("bytes_in", atomic.LoadInt64(&conn.bytesIn)).Int64("bytes_out", atomic.LoadInt64(&conn.bytesOut)).
+			Msg("active connection")
+	}
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err //nolint:wrapcheck
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"go.encore.dev/emissary"
+)
+
+func TestRejected(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		err      error
+		rejected bool
+	}{
+		{err: emissary.ErrUnauthorized, rejected: true},
+		{err: emissary.ErrUnknownKeyID, rejected: true},
+		{err: emissary.ErrClockSkew, rejected: true},
+		{err: emissary.ErrTargetNotAllowed, rejected: true},
+		{err: emissary.ErrTargetUnreachable, rejected: true},
+		{err: emissary.ErrProtocolVersion, rejected: true},
+		{err: errors.Wrap(emissary.ErrTargetNotAllowed, "unable to dial"), rejected: true},
+		{err: emissary.ErrUDPNotSupported, rejected: false},
+		{err: errors.New("connection refused"), rejected: false},
+		{err: errors.Wrap(errors.New("i/o timeout"), "unable to connect on emissary transport"), rejected: false},
+	}
+
+	for _, test := range tests {
+		if rejected(test.err) != test.rejected {
+			t.Errorf("expected rejected(%q) to be %v", test.err, test.rejected)
+		}
+	}
+}
+
+// TestTunnel_Dial checks dialing retries with a backoff while the emissary server can't be reached, until the retry
+// timeout, but gives up straight away if the server rejects the connection
+func TestTunnel_Dial(t *testing.T) {
+	t.Parallel()
+
+	refused := errors.New("connection refused")
+
+	tests := []struct {
+		name         string
+		errs         []error
+		retryTimeout time.Duration
+		dials        int
+		err          string
+	}{
+		{name: "first attempt", retryTimeout: time.Second, dials: 1},
+		{name: "retried until reachable", errs: []error{refused, refused}, retryTimeout: 5 * time.Second, dials: 3},
+		{name: "no retries without a timeout", errs: []error{refused}, dials: 1, err: "unable to reach emissary server, gave up after 0s"},
+		{
+			// Attempts are made after 0ms, 250ms and 750ms, and the next would be after the timeout
+			name:         "gave up after timeout",
+			errs:         []error{refused, refused, refused, refused, refused},
+			retryTimeout: time.Second,
+			dials:        3,
+			err:          "unable to reach emissary server, gave up after 1s",
+		},
+		{name: "rejected", errs: []error{emissary.ErrTargetNotAllowed}, retryTimeout: 5 * time.Second, dials: 1, err: "emissary server rejected connection to db.internal:5432"},
+		{name: "rejected after retry", errs: []error{refused, emissary.ErrUnauthorized}, retryTimeout: 5 * time.Second, dials: 2, err: "emissary server rejected connection to db.internal:5432"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			dialer := &fakeDialer{errs: test.errs}
+			remote, err := newTunnel(dialer, test.retryTimeout).dialContext(context.Background(), "db.internal:5432")
+			if remote != nil {
+				_ = remote.Close()
+			}
+
+			switch {
+			case test.err != "":
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+			case err != nil:
+				t.Fatalf("unable to dial: %v", err)
+			}
+			if len(dialer.dialled) != test.dials {
+				t.Fatalf("expected %d dials, got %d", test.dials, len(dialer.dialled))
+			}
+			for _, target := range dialer.dialled {
+				if target != "db.internal:5432" {
+					t.Fatalf("expected to dial db.internal:5432, got %s", target)
+				}
+			}
+		})
+	}
+}
+
+// TestTunnel_Dial_LocalHangsUp checks we stop retrying to reach the emissary server once the local client has gone
+func TestTunnel_Dial_LocalHangsUp(t *testing.T) {
+	t.Parallel()
+
+	client, conn := net.Pipe()
+	local := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	defer func() { _ = local.Close() }()
+
+	refused := errors.New("connection refused")
+	dialer := &fakeDialer{errs: []error{refused, refused, refused, refused, refused, refused, refused, refused}}
+	time.AfterFunc(100*time.Millisecond, func() { _ = client.Close() })
+
+	start := time.Now()
+	_, err := newTunnel(dialer, time.Minute).dial(local, "db.internal:5432")
+	if err == nil || !strings.Contains(err.Error(), "local client hung up while dialing db.internal:5432") {
+		t.Fatalf("expected dialing to stop as the local client hung up, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected dialing to stop once the local client hung up, took %s", elapsed)
+	}
+}
+
+// TestTunnel_Dial_KeepsData checks what the local client sends while we're dialing is still there to be relayed
+func TestTunnel_Dial_KeepsData(t *testing.T) {
+	t.Parallel()
+
+	client, conn := net.Pipe()
+	local := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	defer func() { _ = client.Close() }()
+	defer func() { _ = local.Close() }()
+	go func() { _, _ = client.Write([]byte("hello")) }()
+
+	remote, err := newTunnel(&fakeDialer{}, time.Minute).dial(local, "db.internal:5432")
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	_ = remote.Close()
+
+	data := make([]byte, 5)
+	if _, err := io.ReadFull(local, data); err != nil {
+		t.Fatalf("unable to read from local client: %v", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("expected to read hello, got %q", data)
+	}
+}
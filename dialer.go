@@ -3,30 +3,31 @@ package emissary
 import (
 	"context"
 	"encoding/base64"
+	"fmt"
 	"net"
+	"strconv"
+	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/rs/zerolog/log"
 	"go.encore.dev/emissary/internal/auth"
 	"go.encore.dev/emissary/internal/emissaryproto"
 	"golang.org/x/net/proxy"
-	"google.golang.org/protobuf/proto"
 )
 
 const BufSize = 1024
 
-type transportDialer interface {
-	proxy.Dialer
-	proxy.ContextDialer
-}
-
 // Dialer is the primary dialer that is exposed from this library.
+//
+// Against servers which support it, connections made through the same Dialer are multiplexed over a shared
+// pool of transport sessions, so Close should be called once the Dialer is no longer needed.
 type Dialer struct {
-	transportLayer transportDialer
+	transportLayer Transport
 	key            Key
+	sessions       sessionPool
 }
 
-var _ transportDialer = (*Dialer)(nil)
+var _ Transport = (*Dialer)(nil)
 
 // NewWebsocketDialer creates a dialer which will connect to emissary over a websocket.
 func NewWebsocketDialer(server string, key Key) *Dialer {
@@ -36,77 +37,247 @@ func NewWebsocketDialer(server string, key Key) *Dialer {
 	}
 }
 
+// NewTCPDialer creates a dialer which will connect to emissary over a raw TCP connection.
+//
+// The server address should be given as a host:port pair.
+func NewTCPDialer(server string, key Key) *Dialer {
+	return &Dialer{
+		transportLayer: &tcpDialer{address: server},
+		key:            key,
+	}
+}
+
 func (e *Dialer) Dial(network, addr string) (c net.Conn, err error) {
 	return e.DialContext(context.Background(), network, addr)
 }
 
+// DialContext connects to the address through the Emissary server.
+//
+// The network may be "tcp" or, against servers which support multiplexed sessions, "udp", in which case the
+// returned connection sends and receives datagrams to the address, as with a connected UDP socket.
 func (e *Dialer) DialContext(ctx context.Context, network, addr string) (c net.Conn, err error) {
-	// Dial the transport layer
-	transportLayer, err := e.transportLayer.DialContext(ctx, network, addr)
+	stream, session, legacy, err := e.newStream(ctx, addr)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to connect on emissary transport")
+		return nil, err
 	}
 
-	// Read the connect message and then verify it's the support protocol version
+	if legacy != nil {
+		// Older servers only support a single SOCKS5 stream per transport
+		if isUDP(network) {
+			_ = legacy.conn.Close()
+			return nil, errors.Wrap(ErrUDPNotSupported, "server only supports protocol version 1")
+		}
+
+		conn, err := dialSOCKS5(ctx, network, addr, legacy.conn, legacy.login)
+		return conn, withClockSkew(err, legacy.connectMessage)
+	}
+
+	return dialStream(ctx, network, addr, stream, session.connectMessage)
+}
+
+// newStream opens a new stream within a multiplexed session with the server, reusing a session from the pool if
+// there is one with capacity, otherwise connecting a new one. Only one session is connected at a time, so concurrent
+// dials wait for it rather than each connecting their own.
+//
+// Servers which only support protocol version 1 can't carry streams, so a transport layer for a single SOCKS5
+// stream is returned instead.
+func (e *Dialer) newStream(ctx context.Context, addr string) (*sessionStream, *session, *legacyTransport, error) {
+	for {
+		// If we already have a multiplexed session open with the server, use a new stream within it
+		if session := e.sessions.get(); session != nil {
+			stream, err := openStream(session)
+			if err == nil {
+				return stream, session, nil, nil
+			}
+			log.Debug().Err(err).Msg("unable to reuse emissary session, opening a new one")
+
+			// The session may still have streams open, so we leave it to close once the server is done with it
+			e.sessions.remove(session)
+			continue
+		}
+
+		wait, connect := e.sessions.startConnect()
+		if connect {
+			break
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, nil, nil, errors.Wrap(ctx.Err(), "unable to connect on emissary transport")
+		}
+	}
+	defer e.sessions.finishConnect()
+
+	session, legacy, err := e.connect(ctx, addr)
+	if err != nil || legacy != nil {
+		return nil, nil, legacy, err
+	}
+
+	stream, err := openStream(session)
+	if err != nil {
+		// Nothing else can be using the session yet, so it's closed rather than left in the pool
+		e.sessions.remove(session)
+		_ = session.Close()
+		return nil, nil, nil, err
+	}
+	return stream, session, nil, nil
+}
+
+// legacyTransport is an authenticated transport layer to a server which only supports protocol version 1, which
+// can carry a single SOCKS5 stream.
+type legacyTransport struct {
+	conn           net.Conn
+	connectMessage *emissaryproto.ServerConnect
+	login          *proxy.Auth
+}
+
+// connect dials a new transport layer to the server and picks the protocol version to speak over it.
+//
+// Against servers which support multiplexed sessions, a new session is started over the transport layer and added to
+// the pool. Otherwise, the transport layer is returned along with our login, to carry a single SOCKS5 stream.
+func (e *Dialer) connect(ctx context.Context, addr string) (*session, *legacyTransport, error) {
+	// Dial the transport layer, which is always a TCP stream, even when tunnelling UDP
+	transportLayer, err := e.transportLayer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to connect on emissary transport")
+	}
+
+	// Read the connect message and then pick the protocol version to speak
 	connectMessage, err := readConnectMessage(transportLayer)
 	if err != nil {
 		_ = transportLayer.Close()
-		return nil, errors.Wrap(err, "unable to read connect message")
+		return nil, nil, errors.Wrap(err, "unable to read connect message")
 	}
-	if connectMessage.ProtocolVersion != emissaryproto.ProtocolVersion {
+	version, err := negotiateProtocolVersion(connectMessage)
+	if err != nil {
+		_ = transportLayer.Close()
+		return nil, nil, err
+	}
+
+	switch version {
+	case emissaryproto.LegacyProtocolVersion:
+		login, err := e.login(connectMessage)
+		if err != nil {
+			_ = transportLayer.Close()
+			return nil, nil, err
+		}
+		return nil, &legacyTransport{conn: transportLayer, connectMessage: connectMessage, login: login}, nil
+
+	case emissaryproto.ProtocolVersion:
+		login, err := e.login(connectMessage)
+		if err != nil {
+			_ = transportLayer.Close()
+			return nil, nil, err
+		}
+
+		session, err := newSession(transportLayer, connectMessage, login)
+		if err != nil {
+			_ = transportLayer.Close()
+			return nil, nil, err
+		}
+		e.sessions.add(session)
+		return session, nil, nil
+
+	default:
 		_ = transportLayer.Close()
-		return nil, errors.Newf("unsupported emissary protocol version: supports %d, got %d", emissaryproto.ProtocolVersion, connectMessage.ProtocolVersion) //nolint:wrapcheck
+		return nil, nil, errors.Wrapf(ErrProtocolVersion, "negotiated unknown version %d", version)
+	}
+}
+
+// negotiateProtocolVersion picks the highest protocol version supported by both us and the server.
+func negotiateProtocolVersion(connectMessage *emissaryproto.ServerConnect) (int32, error) {
+	// Servers from before version negotiation only support the one version they send
+	minVersion, maxVersion := connectMessage.ProtocolVersion, connectMessage.ProtocolVersion
+	if connectMessage.MaxProtocolVersion > 0 {
+		minVersion, maxVersion = connectMessage.MinProtocolVersion, connectMessage.MaxProtocolVersion
+	}
+
+	version := maxVersion
+	if version > emissaryproto.ProtocolVersion {
+		version = emissaryproto.ProtocolVersion
+	}
+	if version < minVersion || version < emissaryproto.MinProtocolVersion {
+		return 0, errors.Wrapf(ErrProtocolVersion, "supports %d to %d, server supports %d to %d",
+			emissaryproto.MinProtocolVersion, emissaryproto.ProtocolVersion, minVersion, maxVersion)
+	}
+
+	log.Debug().Int32("protocol_version", version).Strs("features", connectMessage.Features).Msg("negotiated emissary protocol version")
+	return version, nil
+}
+
+// login signs the connection nonce with our key.
+//
+// If the dialer has no key, then we are relying on a client certificate to authenticate us, so nil is returned.
+func (e *Dialer) login(connectMessage *emissaryproto.ServerConnect) (*proxy.Auth, error) {
+	if len(e.key.Data) == 0 {
+		return nil, nil //nolint:nilnil
 	}
 
-	// Create the login information
 	date, hmac, err := auth.SignRequest(e.key, base64.RawStdEncoding.EncodeToString(connectMessage.ConnectionNonce))
 	if err != nil {
-		_ = transportLayer.Close()
 		return nil, errors.Wrap(err, "unable to create emissary login")
 	}
 
-	// Now upgrade the connection to a SOCKS5 client
-	socks5, err := proxy.SOCKS5(network, addr, &proxy.Auth{
+	return &proxy.Auth{
 		User:     date,
 		Password: hmac,
-	}, &withOpenTransport{transportLayer})
+	}, nil
+}
+
+// Close closes any multiplexed sessions held open by the dialer, including all connections made through them.
+func (e *Dialer) Close() error {
+	return e.sessions.close()
+}
+
+// dialStream asks the Emissary server to connect to the target address over a stream within an authenticated session.
+func dialStream(ctx context.Context, network, addr string, stream net.Conn, connectMessage *emissaryproto.ServerConnect) (net.Conn, error) {
+	if !isUDP(network) {
+		return dialSOCKS5(ctx, network, addr, stream, nil)
+	}
+
+	if !connectMessage.HasFeature(emissaryproto.FeatureUDP) {
+		_ = stream.Close()
+		return nil, ErrUDPNotSupported
+	}
+	return dialUDP(ctx, addr, stream)
+}
+
+// dialSOCKS5 asks the Emissary server to connect to the target address over an already established transport layer.
+//
+// If auth is nil, then the transport layer must be a stream within an already authenticated session.
+//
+// If the server rejects the request, it tells us why after the SOCKS5 reply, which is returned as one of our errors.
+func dialSOCKS5(ctx context.Context, network, addr string, transportLayer net.Conn, auth *proxy.Auth) (net.Conn, error) {
+	// Now upgrade the connection to a SOCKS5 client
+	socks5, err := proxy.SOCKS5(network, addr, auth, &withOpenTransport{transportLayer})
 	if err != nil {
 		_ = transportLayer.Close()
 		return nil, errors.Wrap(err, "unable to create socks5 proxy dialer")
 	}
 
-	// And tell the SOCKS5 proxy to now dail and authenticate
-	if withCtx, ok := socks5.(proxy.ContextDialer); ok {
-		c, err := withCtx.DialContext(ctx, network, addr)
-		if err != nil {
-			_ = transportLayer.Close()
-			return nil, errors.Wrap(err, "unable to dial socks 5 proxy")
-		}
-		return c, nil
-	} else {
-		c, err := socks5.Dial(network, addr)
-		if err != nil {
-			_ = transportLayer.Close()
-			return nil, errors.Wrap(err, "unable to dial socks 5 proxy")
+	// And tell the SOCKS5 proxy to now dial and authenticate. Unlike DialContext, DialWithConn leaves the transport layer
+	// open if the server rejects us, so we can read why
+	withConn, ok := socks5.(socks5ConnDialer)
+	if !ok {
+		_ = transportLayer.Close()
+		return nil, errors.New("socks5 proxy dialer does not support dialing over an open connection")
+	}
+	if _, err := withConn.DialWithConn(ctx, transportLayer, network, addr); err != nil {
+		if reason := readHandshakeError(ctx, transportLayer); reason != nil {
+			err = reason
 		}
-		return c, nil
+		_ = transportLayer.Close()
+		return nil, errors.Wrap(err, "unable to dial socks 5 proxy")
 	}
+	return transportLayer, nil
 }
 
 // readConnectMessage gets and unmarshals the connection header from the server.
 func readConnectMessage(transportLayer net.Conn) (*emissaryproto.ServerConnect, error) {
 	// Read the message
-	buf := make([]byte, BufSize)
-	n, err := transportLayer.Read(buf)
+	connectMessage, err := emissaryproto.ReadConnectMessage(transportLayer)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to read connect message")
-	}
-	if n == 0 {
-		return nil, errors.New("no connect message sent")
-	}
-	connectMessage := &emissaryproto.ServerConnect{}
-	if err := proto.Unmarshal(buf[:n], connectMessage); err != nil {
-		return nil, errors.Wrap(err, "unable to unmarshal connect message")
+		return nil, err //nolint:wrapcheck
 	}
 
 	// Verify the constants are set as expected
@@ -123,14 +294,40 @@ func readConnectMessage(transportLayer net.Conn) (*emissaryproto.ServerConnect,
 		return nil, errors.New("connection nonce was all zeros")
 	}
 
+	skew := clockSkew(connectMessage)
 	log.Debug().Str("server", connectMessage.ServerSoftware).
 		Str("server_version", connectMessage.ServerVersion).
 		Int32("protocol_version", connectMessage.ProtocolVersion).
+		Dur("clock_skew", skew).
 		Msg("connected to emissary server via transport layer")
 
+	if skew > auth.DefaultMaxClockSkew || skew < -auth.DefaultMaxClockSkew {
+		log.Warn().Msgf("local clock is %s, so authentication is likely to fail", describeClockSkew(skew))
+	}
+
 	return connectMessage, nil
 }
 
+// clockSkew returns how far our clock is ahead of the server's, or zero if the server did not send its clock.
+func clockSkew(connectMessage *emissaryproto.ServerConnect) time.Duration {
+	if connectMessage.ServerTime == 0 {
+		return 0
+	}
+	return time.Since(time.UnixMilli(connectMessage.ServerTime))
+}
+
+func describeClockSkew(skew time.Duration) string {
+	if skew < 0 {
+		return fmt.Sprintf("%s behind the emissary server", (-skew).Round(time.Second))
+	}
+	return fmt.Sprintf("%s ahead of the emissary server", skew.Round(time.Second))
+}
+
+// socks5ConnDialer is implemented by the x/net SOCKS5 dialer, to dial over a connection to the SOCKS5 server
+type socks5ConnDialer interface {
+	DialWithConn(ctx context.Context, c net.Conn, network, address string) (net.Addr, error)
+}
+
 type withOpenTransport struct {
 	conn net.Conn
 }
@@ -139,6 +336,28 @@ func (w *withOpenTransport) Dial(_, _ string) (c net.Conn, err error) {
 	return w.conn, nil
 }
 
+// splitTargetAddr splits a target address into its host and port
+func splitTargetAddr(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "invalid address")
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return "", 0, errors.Newf("invalid port %q", portStr)
+	}
+	return host, port, nil
+}
+
+// targetAddr is the address of a target given by hostname, which is only resolved by the Emissary server
+type targetAddr struct {
+	network string
+	addr    string
+}
+
+func (a *targetAddr) Network() string { return a.network }
+func (a *targetAddr) String() string  { return a.addr }
+
 func allZero(s []byte) bool {
 	for _, v := range s {
 		if v != 0 {
@@ -0,0 +1,44 @@
+package emissary
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"github.com/cockroachdb/errors"
+	"golang.org/x/net/proxy"
+)
+
+// The tcp dialer is one way of accessing an Emissary server, by connecting directly to
+// the raw TCP port exposed by the server.
+type tcpDialer struct {
+	address   string
+	tlsConfig *tls.Config // if set, the connection will be made over TLS
+}
+
+var _ Transport = (*tcpDialer)(nil)
+
+func (t *tcpDialer) Dial(network, addr string) (c net.Conn, err error) {
+	return t.DialContext(context.Background(), network, addr)
+}
+
+func (t *tcpDialer) DialContext(ctx context.Context, network, _ string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, errors.New("tcp only supported")
+	}
+
+	netDialer := &net.Dialer{
+		Timeout:   HandshakeTimeout,
+		KeepAlive: PingTime,
+	}
+	var dialer proxy.ContextDialer = netDialer
+	if t.tlsConfig != nil {
+		dialer = &tls.Dialer{NetDialer: netDialer, Config: t.tlsConfig}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", t.address)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to connect to the emissary tcp server")
+	}
+
+	return conn, nil
+}
@@ -2,6 +2,7 @@ package emissary
 
 import (
 	"context"
+	"crypto/tls"
 	"io"
 	"net"
 	"time"
@@ -9,6 +10,7 @@ import (
 	"github.com/cockroachdb/errors"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
+	"go.encore.dev/emissary/internal/emissaryproto"
 	"go.encore.dev/emissary/internal/ws"
 )
 
@@ -17,10 +19,14 @@ const PingTime = 30 * time.Second
 
 // The websocket dialer is one way of accessing an Emissary server.
 type websocketDialer struct {
-	address string
+	address          string
+	tlsConfig        *tls.Config     // used for wss:// addresses; nil means the default configuration
+	writeOptions     ws.WriteOptions // how writes are sent as websocket messages
+	compress         bool            // if we ask the server to compress messages
+	compressionLevel int             // the flate level to compress messages at, if the server agrees
 }
 
-var _ transportDialer = (*websocketDialer)(nil)
+var _ Transport = (*websocketDialer)(nil)
 
 func (w *websocketDialer) Dial(network, addr string) (c net.Conn, err error) {
 	return w.DialContext(context.Background(), network, addr)
@@ -33,25 +39,36 @@ func (w *websocketDialer) DialContext(ctx context.Context, network, _ string) (n
 
 	// Dial the basic websocket
 	dialer := &websocket.Dialer{
-		HandshakeTimeout: HandshakeTimeout,
+		HandshakeTimeout:  HandshakeTimeout,
+		TLSClientConfig:   w.tlsConfig,
+		Subprotocols:      []string{ws.HalfCloseSubprotocol, emissaryproto.FramedConnectSubprotocol},
+		WriteBufferPool:   ws.WriteBufferPool,
+		EnableCompression: w.compress,
 	}
-	wsc, _, err := dialer.DialContext(ctx, w.address, nil)
+	wsc, resp, err := dialer.DialContext(ctx, w.address, nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to connect to the emissary websocket")
 	}
-	wsc.EnableWriteCompression(true)
 
 	// Wrap the websocket so it can be used like a net.Conn and return it
-	conn := ws.NewClient(wsc)
+	conn := ws.NewClientWithOptions(wsc, w.writeOptions)
 
-	// Startup a background keep-alive so the socket doesn't close when there's no traffic
+	// The server only compresses messages if it has been configured to
+	if w.compress && ws.DeflateNegotiated(resp.Header) {
+		if err := conn.EnableCompression(w.compressionLevel); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
+	// Startup a background keep-alive so the socket doesn't close when there's no traffic, for as long as it's open
 	go func() {
 		t := time.NewTicker(PingTime)
 		defer t.Stop()
 
 		for {
 			select {
-			case <-ctx.Done():
+			case <-conn.Done():
 				return
 
 			case <-t.C:
@@ -0,0 +1,115 @@
+package emissary
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"go.encore.dev/emissary/internal/emissaryproto"
+)
+
+// These errors are returned by Dialer.DialContext and Dialer.Listen when the Emissary server rejects a connection,
+// and can be checked for with errors.Is. Servers which are too old to say why they rejected a connection will cause
+// a generic error to be returned instead.
+var (
+	// ErrUnauthorized is returned when the server did not accept our key or client certificate
+	ErrUnauthorized = errors.New("emissary server rejected our credentials")
+
+	// ErrUnknownKeyID is returned when the server does not know the key we signed our credentials with
+	ErrUnknownKeyID = errors.New("emissary server does not know our key id")
+
+	// ErrClockSkew is returned when our credentials were valid, but the server rejected them as our clock is
+	// too far out of sync with the server's
+	ErrClockSkew = errors.New("emissary server rejected our credentials as the local clock is out of sync with it")
+
+	// ErrTargetNotAllowed is returned when we are not allowed to connect to the target through the server
+	ErrTargetNotAllowed = errors.New("emissary server does not allow connections to the target")
+
+	// ErrTargetUnreachable is returned when the server was unable to resolve or connect to the target
+	ErrTargetUnreachable = errors.New("emissary server was unable to connect to the target")
+
+	// ErrProtocolVersion is returned when we and the server do not support a common protocol version
+	ErrProtocolVersion = errors.New("emissary server does not support our protocol version")
+
+	// ErrUDPNotSupported is returned when dialing a UDP target through a server which does not support it
+	ErrUDPNotSupported = errors.New("emissary server does not support udp")
+
+	// ErrListenNotSupported is returned when listening through a server which does not support it
+	ErrListenNotSupported = errors.New("emissary server does not support listening")
+
+	// ErrListenFailed is returned when the server was allowed to listen on the address, but was unable to
+	ErrListenFailed = errors.New("emissary server was unable to listen on the address")
+)
+
+// handshakeErrorTimeout is how long we wait for the server to tell us why it rejected our handshake
+const handshakeErrorTimeout = 5 * time.Second
+
+// readHandshakeError reads why the server rejected our handshake, returning nil if it didn't tell us.
+func readHandshakeError(ctx context.Context, transportLayer net.Conn) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	deadline := time.Now().Add(handshakeErrorTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	_ = transportLayer.SetReadDeadline(deadline)
+
+	msg, err := emissaryproto.ReadHandshakeError(transportLayer)
+	if err != nil {
+		return nil
+	}
+
+	var reason error
+	switch msg.Reason {
+	case emissaryproto.HandshakeError_UNAUTHORIZED:
+		reason = ErrUnauthorized
+	case emissaryproto.HandshakeError_UNKNOWN_KEY_ID:
+		reason = ErrUnknownKeyID
+	case emissaryproto.HandshakeError_CLOCK_SKEW:
+		reason = ErrClockSkew
+	case emissaryproto.HandshakeError_TARGET_NOT_ALLOWED:
+		reason = ErrTargetNotAllowed
+	case emissaryproto.HandshakeError_TARGET_UNREACHABLE:
+		reason = ErrTargetUnreachable
+	case emissaryproto.HandshakeError_PROTOCOL_VERSION:
+		reason = ErrProtocolVersion
+	case emissaryproto.HandshakeError_LISTEN_FAILED:
+		reason = ErrListenFailed
+	default:
+		return errors.Newf("emissary server rejected the handshake: %s", msg.Message)
+	}
+
+	if msg.Message == "" {
+		return reason
+	}
+	return errors.Wrap(reason, msg.Message)
+}
+
+// sessionAuthError returns the error for the server's response to our session auth message.
+func sessionAuthError(status emissaryproto.SessionAuthStatus) error {
+	switch status {
+	case emissaryproto.SessionAuthSuccess:
+		return nil
+	case emissaryproto.SessionAuthUnknownKeyID:
+		return ErrUnknownKeyID
+	case emissaryproto.SessionAuthClockSkew:
+		return ErrClockSkew
+	case emissaryproto.SessionAuthReplayed:
+		return errors.Wrap(ErrUnauthorized, "credentials have already been used")
+	default:
+		return ErrUnauthorized
+	}
+}
+
+// withClockSkew adds how far our clock is from the server's to clock skew errors.
+func withClockSkew(err error, connectMessage *emissaryproto.ServerConnect) error {
+	if !errors.Is(err, ErrClockSkew) {
+		return err
+	}
+	if skew := clockSkew(connectMessage); skew != 0 {
+		return errors.Wrapf(err, "local clock is %s", describeClockSkew(skew))
+	}
+	return err
+}
@@ -5,10 +5,12 @@ go 1.18
 require (
 	github.com/cockroachdb/errors v1.9.0
 	github.com/gorilla/websocket v1.5.0
+	github.com/hashicorp/yamux v0.1.1
 	github.com/rs/zerolog v1.26.1
 	go.uber.org/atomic v1.9.0
 	golang.org/x/net v0.17.0
 	google.golang.org/protobuf v1.26.0
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
@@ -14,6 +14,20 @@ import (
 
 const keyIDLen = 4
 
+// DefaultMaxClockSkew is how far the date a request was signed at may be from our clock, if not otherwise configured
+const DefaultMaxClockSkew = 15 * time.Minute
+
+var (
+	// ErrUnknownKeyID is returned when a request is signed by a key we do not know about
+	ErrUnknownKeyID = errors.New("no matching key ID found")
+
+	// ErrBadSignature is returned when a request was not signed correctly by the key it claims to be signed by
+	ErrBadSignature = errors.New("bad signature")
+
+	// ErrClockSkew is returned when a request was signed correctly, but at a date too far from our clock
+	ErrClockSkew = errors.New("signature date outside of allowed clock skew")
+)
+
 // Key is a MAC key for authenticating communication between
 // an Encore app and the Encore Platform. It is designed to be
 // JSON marshalable, but as it contains secret material care
@@ -42,46 +56,55 @@ func SignRequest(key Key, content string) (date string, sig string, err error) {
 	return date, auth, nil
 }
 
-func ValidateRequest(keys Keys, date, content, sig string) error {
+// ValidateRequest checks the signature was created by one of the given keys, at a date within maxSkew of our
+// clock, returning the ID of that key. If maxSkew is zero, DefaultMaxClockSkew is used.
+func ValidateRequest(keys Keys, date, content, sig string, maxSkew time.Duration) (keyID uint32, err error) {
 	macBytes, err := base64.RawStdEncoding.DecodeString(sig)
 	if err != nil {
-		return errors.New("invalid signature format")
+		return 0, errors.New("invalid signature format")
 	}
 
 	if len(macBytes) < keyIDLen {
-		return errors.New("signature too short")
+		return 0, errors.New("signature too short")
 	}
-	keyID := binary.BigEndian.Uint32(macBytes[:keyIDLen])
+	keyID = binary.BigEndian.Uint32(macBytes[:keyIDLen])
 	mac := macBytes[keyIDLen:]
 
 	for _, k := range keys {
 		if k.KeyID == keyID {
-			if checkAuth(k, date, content, mac) {
-				return nil
+			if err := checkAuth(k, date, content, mac, maxSkew); err != nil {
+				return 0, err
 			}
-
-			return errors.New("bad signature")
+			return keyID, nil
 		}
 	}
 
-	return errors.New("no matching key ID found")
+	return 0, ErrUnknownKeyID
 }
 
-func checkAuth(key Key, dateStr, content string, gotMac []byte) bool {
+// checkAuth checks the signature before the date, so that a client with a bad clock can be told apart
+// from one with a bad key.
+func checkAuth(key Key, dateStr, content string, gotMac []byte, maxSkew time.Duration) error {
 	if dateStr == "" {
-		return false
+		return ErrBadSignature
 	}
 	date, err := http.ParseTime(dateStr)
 	if err != nil {
-		return false
-	}
-	const threshold = 15 * time.Minute
-	if diff := time.Since(date); diff > threshold || diff < -threshold {
-		return false
+		return ErrBadSignature
 	}
 
 	mac := hmac.New(sha256.New, key.Data)
 	_, _ = fmt.Fprintf(mac, "%s\x00%s", dateStr, content)
 	expected := mac.Sum(nil)
-	return hmac.Equal(expected, gotMac)
+	if !hmac.Equal(expected, gotMac) {
+		return ErrBadSignature
+	}
+
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxClockSkew
+	}
+	if skew := time.Since(date); skew > maxSkew || skew < -maxSkew {
+		return errors.Wrapf(ErrClockSkew, "signed %s from our clock, allowed %s", skew.Round(time.Second), maxSkew)
+	}
+	return nil
 }
@@ -0,0 +1,87 @@
+package emissaryproto
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/cockroachdb/errors"
+	"google.golang.org/protobuf/proto"
+)
+
+// The connect message was originally sent unframed, relying on the websocket message boundary to delimit it. That
+// doesn't work over a stream transport, so it is now sent as a frame of FramedConnectMarker, the length of the
+// message as a big endian uint16 and then the message itself.
+//
+// The marker can never start an unframed message, as protobuf field numbers start at 1, so clients can read either.
+// Servers only send the framed message to websocket clients which ask for it with the FramedConnectSubprotocol (or
+// ws.HalfCloseSubprotocol, which implies it), as older clients expect the unframed message.
+const (
+	FramedConnectMarker      = 0x00
+	FramedConnectSubprotocol = "emissary.framed-connect"
+)
+
+// MaxUnframedConnectSize is the largest unframed connect message we will read
+const MaxUnframedConnectSize = 1024
+
+// WriteConnectMessage writes the connect message, framed unless the client is only able to read unframed messages.
+func WriteConnectMessage(w io.Writer, msg *ServerConnect, framed bool) error {
+	bytes, err := proto.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal connect message")
+	}
+
+	if framed {
+		if len(bytes) > 0xFFFF {
+			return errors.New("connect message too long")
+		}
+
+		buf := make([]byte, 3, 3+len(bytes))
+		buf[0] = FramedConnectMarker
+		binary.BigEndian.PutUint16(buf[1:], uint16(len(bytes)))
+		bytes = append(buf, bytes...)
+	}
+
+	if _, err := w.Write(bytes); err != nil {
+		return errors.Wrap(err, "unable to send connect message")
+	}
+	return nil
+}
+
+// ReadConnectMessage reads the connect message written by WriteConnectMessage, whether or not it was framed.
+//
+// An unframed message is read with a single read, so must only be sent over a transport which preserves message
+// boundaries. A framed message is read exactly, so nothing the server sends after it is consumed.
+func ReadConnectMessage(r io.Reader) (*ServerConnect, error) {
+	first := []byte{0}
+	if _, err := io.ReadFull(r, first); err != nil {
+		return nil, errors.Wrap(err, "unable to read connect message")
+	}
+
+	var bytes []byte
+	if first[0] == FramedConnectMarker {
+		header := []byte{0, 0}
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, errors.Wrap(err, "unable to read connect message length")
+		}
+
+		bytes = make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(r, bytes); err != nil {
+			return nil, errors.Wrap(err, "unable to read connect message")
+		}
+	} else {
+		// Anything left in the websocket message is returned by the next read
+		buf := make([]byte, MaxUnframedConnectSize)
+		buf[0] = first[0]
+		n, err := r.Read(buf[1:])
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, errors.Wrap(err, "unable to read connect message")
+		}
+		bytes = buf[:1+n]
+	}
+
+	msg := &ServerConnect{}
+	if err := proto.Unmarshal(bytes, msg); err != nil {
+		return nil, errors.Wrap(err, "unable to unmarshal connect message")
+	}
+	return msg, nil
+}
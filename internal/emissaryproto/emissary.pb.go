@@ -20,15 +20,83 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+type HandshakeError_Reason int32
+
+const (
+	HandshakeError_UNSPECIFIED        HandshakeError_Reason = 0
+	HandshakeError_UNAUTHORIZED       HandshakeError_Reason = 1 // The client's credentials were not valid
+	HandshakeError_UNKNOWN_KEY_ID     HandshakeError_Reason = 2 // The client signed its credentials with a key the server does not know about
+	HandshakeError_CLOCK_SKEW         HandshakeError_Reason = 3 // The client's credentials were valid, but signed too far from the server's clock
+	HandshakeError_TARGET_NOT_ALLOWED HandshakeError_Reason = 4 // The client is not allowed to connect to the target
+	HandshakeError_TARGET_UNREACHABLE HandshakeError_Reason = 5 // The server was unable to resolve or connect to the target
+	HandshakeError_PROTOCOL_VERSION   HandshakeError_Reason = 6 // The client spoke a protocol the server does not support
+	HandshakeError_LISTEN_FAILED      HandshakeError_Reason = 7 // The server was unable to listen on the address the client asked for
+)
+
+// Enum value maps for HandshakeError_Reason.
+var (
+	HandshakeError_Reason_name = map[int32]string{
+		0: "UNSPECIFIED",
+		1: "UNAUTHORIZED",
+		2: "UNKNOWN_KEY_ID",
+		3: "CLOCK_SKEW",
+		4: "TARGET_NOT_ALLOWED",
+		5: "TARGET_UNREACHABLE",
+		6: "PROTOCOL_VERSION",
+		7: "LISTEN_FAILED",
+	}
+	HandshakeError_Reason_value = map[string]int32{
+		"UNSPECIFIED":        0,
+		"UNAUTHORIZED":       1,
+		"UNKNOWN_KEY_ID":     2,
+		"CLOCK_SKEW":         3,
+		"TARGET_NOT_ALLOWED": 4,
+		"TARGET_UNREACHABLE": 5,
+		"PROTOCOL_VERSION":   6,
+		"LISTEN_FAILED":      7,
+	}
+)
+
+func (x HandshakeError_Reason) Enum() *HandshakeError_Reason {
+	p := new(HandshakeError_Reason)
+	*p = x
+	return p
+}
+
+func (x HandshakeError_Reason) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (HandshakeError_Reason) Descriptor() protoreflect.EnumDescriptor {
+	return file_emissary_proto_enumTypes[0].Descriptor()
+}
+
+func (HandshakeError_Reason) Type() protoreflect.EnumType {
+	return &file_emissary_proto_enumTypes[0]
+}
+
+func (x HandshakeError_Reason) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use HandshakeError_Reason.Descriptor instead.
+func (HandshakeError_Reason) EnumDescriptor() ([]byte, []int) {
+	return file_emissary_proto_rawDescGZIP(), []int{1, 0}
+}
+
 type ServerConnect struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	ServerSoftware  string `protobuf:"bytes,1,opt,name=server_software,json=serverSoftware,proto3" json:"server_software,omitempty"`     // What's the server software name
-	ServerVersion   string `protobuf:"bytes,2,opt,name=server_version,json=serverVersion,proto3" json:"server_version,omitempty"`        // What's the server's version
-	ProtocolVersion int32  `protobuf:"varint,3,opt,name=protocol_version,json=protocolVersion,proto3" json:"protocol_version,omitempty"` // What's the protocol version we're going to use
-	ConnectionNonce []byte `protobuf:"bytes,4,opt,name=connection_nonce,json=connectionNonce,proto3" json:"connection_nonce,omitempty"`  // What's the server's requested nonce
+	ServerSoftware     string   `protobuf:"bytes,1,opt,name=server_software,json=serverSoftware,proto3" json:"server_software,omitempty"`                // What's the server software name
+	ServerVersion      string   `protobuf:"bytes,2,opt,name=server_version,json=serverVersion,proto3" json:"server_version,omitempty"`                   // What's the server's version
+	ProtocolVersion    int32    `protobuf:"varint,3,opt,name=protocol_version,json=protocolVersion,proto3" json:"protocol_version,omitempty"`            // What's the protocol version clients which don't negotiate should use
+	ConnectionNonce    []byte   `protobuf:"bytes,4,opt,name=connection_nonce,json=connectionNonce,proto3" json:"connection_nonce,omitempty"`             // What's the server's requested nonce
+	ServerTime         int64    `protobuf:"varint,5,opt,name=server_time,json=serverTime,proto3" json:"server_time,omitempty"`                           // What's the server's clock, as unix milliseconds, so clients can detect clock skew
+	MinProtocolVersion int32    `protobuf:"varint,6,opt,name=min_protocol_version,json=minProtocolVersion,proto3" json:"min_protocol_version,omitempty"` // What's the lowest protocol version the server supports
+	MaxProtocolVersion int32    `protobuf:"varint,7,opt,name=max_protocol_version,json=maxProtocolVersion,proto3" json:"max_protocol_version,omitempty"` // What's the highest protocol version the server supports
+	Features           []string `protobuf:"bytes,8,rep,name=features,proto3" json:"features,omitempty"`                                                  // What optional features the server supports
 }
 
 func (x *ServerConnect) Reset() {
@@ -91,12 +159,97 @@ func (x *ServerConnect) GetConnectionNonce() []byte {
 	return nil
 }
 
+func (x *ServerConnect) GetServerTime() int64 {
+	if x != nil {
+		return x.ServerTime
+	}
+	return 0
+}
+
+func (x *ServerConnect) GetMinProtocolVersion() int32 {
+	if x != nil {
+		return x.MinProtocolVersion
+	}
+	return 0
+}
+
+func (x *ServerConnect) GetMaxProtocolVersion() int32 {
+	if x != nil {
+		return x.MaxProtocolVersion
+	}
+	return 0
+}
+
+func (x *ServerConnect) GetFeatures() []string {
+	if x != nil {
+		return x.Features
+	}
+	return nil
+}
+
+// HandshakeError is sent by the server after it rejects a client's handshake, just before it closes the connection,
+// so the client can tell why it was rejected
+type HandshakeError struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Reason  HandshakeError_Reason `protobuf:"varint,1,opt,name=reason,proto3,enum=emissaryproto.HandshakeError_Reason" json:"reason,omitempty"` // Why the handshake was rejected
+	Message string                `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`                                         // A human readable description of why the handshake was rejected
+}
+
+func (x *HandshakeError) Reset() {
+	*x = HandshakeError{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_emissary_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *HandshakeError) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HandshakeError) ProtoMessage() {}
+
+func (x *HandshakeError) ProtoReflect() protoreflect.Message {
+	mi := &file_emissary_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HandshakeError.ProtoReflect.Descriptor instead.
+func (*HandshakeError) Descriptor() ([]byte, []int) {
+	return file_emissary_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *HandshakeError) GetReason() HandshakeError_Reason {
+	if x != nil {
+		return x.Reason
+	}
+	return HandshakeError_UNSPECIFIED
+}
+
+func (x *HandshakeError) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
 var File_emissary_proto protoreflect.FileDescriptor
 
 var file_emissary_proto_rawDesc = []byte{
 	0x0a, 0x0e, 0x65, 0x6d, 0x69, 0x73, 0x73, 0x61, 0x72, 0x79, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f,
 	0x12, 0x0d, 0x65, 0x6d, 0x69, 0x73, 0x73, 0x61, 0x72, 0x79, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22,
-	0xb5, 0x01, 0x0a, 0x0d, 0x53, 0x65, 0x72, 0x76, 0x65, 0x72, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63,
+	0xd6, 0x02, 0x0a, 0x0d, 0x53, 0x65, 0x72, 0x76, 0x65, 0x72, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63,
 	0x74, 0x12, 0x27, 0x0a, 0x0f, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72, 0x5f, 0x73, 0x6f, 0x66, 0x74,
 	0x77, 0x61, 0x72, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0e, 0x73, 0x65, 0x72, 0x76,
 	0x65, 0x72, 0x53, 0x6f, 0x66, 0x74, 0x77, 0x61, 0x72, 0x65, 0x12, 0x25, 0x0a, 0x0e, 0x73, 0x65,
@@ -107,9 +260,36 @@ var file_emissary_proto_rawDesc = []byte{
 	0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x29, 0x0a, 0x10,
 	0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x6e, 0x6f, 0x6e, 0x63, 0x65,
 	0x18, 0x04, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0f, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x69,
-	0x6f, 0x6e, 0x4e, 0x6f, 0x6e, 0x63, 0x65, 0x42, 0x10, 0x5a, 0x0e, 0x2f, 0x65, 0x6d, 0x69, 0x73,
-	0x73, 0x61, 0x72, 0x79, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f,
-	0x33,
+	0x6f, 0x6e, 0x4e, 0x6f, 0x6e, 0x63, 0x65, 0x12, 0x1f, 0x0a, 0x0b, 0x73, 0x65, 0x72, 0x76, 0x65,
+	0x72, 0x5f, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0a, 0x73, 0x65,
+	0x72, 0x76, 0x65, 0x72, 0x54, 0x69, 0x6d, 0x65, 0x12, 0x30, 0x0a, 0x14, 0x6d, 0x69, 0x6e, 0x5f,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e,
+	0x18, 0x06, 0x20, 0x01, 0x28, 0x05, 0x52, 0x12, 0x6d, 0x69, 0x6e, 0x50, 0x72, 0x6f, 0x74, 0x6f,
+	0x63, 0x6f, 0x6c, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x30, 0x0a, 0x14, 0x6d, 0x61,
+	0x78, 0x5f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69,
+	0x6f, 0x6e, 0x18, 0x07, 0x20, 0x01, 0x28, 0x05, 0x52, 0x12, 0x6d, 0x61, 0x78, 0x50, 0x72, 0x6f,
+	0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1a, 0x0a, 0x08,
+	0x66, 0x65, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x18, 0x08, 0x20, 0x03, 0x28, 0x09, 0x52, 0x08,
+	0x66, 0x65, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x22, 0x93, 0x02, 0x0a, 0x0e, 0x48, 0x61, 0x6e,
+	0x64, 0x73, 0x68, 0x61, 0x6b, 0x65, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x12, 0x3c, 0x0a, 0x06, 0x72,
+	0x65, 0x61, 0x73, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x24, 0x2e, 0x65, 0x6d,
+	0x69, 0x73, 0x73, 0x61, 0x72, 0x79, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2e, 0x48, 0x61, 0x6e, 0x64,
+	0x73, 0x68, 0x61, 0x6b, 0x65, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x2e, 0x52, 0x65, 0x61, 0x73, 0x6f,
+	0x6e, 0x52, 0x06, 0x72, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x12, 0x18, 0x0a, 0x07, 0x6d, 0x65, 0x73,
+	0x73, 0x61, 0x67, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x6d, 0x65, 0x73, 0x73,
+	0x61, 0x67, 0x65, 0x22, 0xa8, 0x01, 0x0a, 0x06, 0x52, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x12, 0x0f,
+	0x0a, 0x0b, 0x55, 0x4e, 0x53, 0x50, 0x45, 0x43, 0x49, 0x46, 0x49, 0x45, 0x44, 0x10, 0x00, 0x12,
+	0x10, 0x0a, 0x0c, 0x55, 0x4e, 0x41, 0x55, 0x54, 0x48, 0x4f, 0x52, 0x49, 0x5a, 0x45, 0x44, 0x10,
+	0x01, 0x12, 0x12, 0x0a, 0x0e, 0x55, 0x4e, 0x4b, 0x4e, 0x4f, 0x57, 0x4e, 0x5f, 0x4b, 0x45, 0x59,
+	0x5f, 0x49, 0x44, 0x10, 0x02, 0x12, 0x0e, 0x0a, 0x0a, 0x43, 0x4c, 0x4f, 0x43, 0x4b, 0x5f, 0x53,
+	0x4b, 0x45, 0x57, 0x10, 0x03, 0x12, 0x16, 0x0a, 0x12, 0x54, 0x41, 0x52, 0x47, 0x45, 0x54, 0x5f,
+	0x4e, 0x4f, 0x54, 0x5f, 0x41, 0x4c, 0x4c, 0x4f, 0x57, 0x45, 0x44, 0x10, 0x04, 0x12, 0x16, 0x0a,
+	0x12, 0x54, 0x41, 0x52, 0x47, 0x45, 0x54, 0x5f, 0x55, 0x4e, 0x52, 0x45, 0x41, 0x43, 0x48, 0x41,
+	0x42, 0x4c, 0x45, 0x10, 0x05, 0x12, 0x14, 0x0a, 0x10, 0x50, 0x52, 0x4f, 0x54, 0x4f, 0x43, 0x4f,
+	0x4c, 0x5f, 0x56, 0x45, 0x52, 0x53, 0x49, 0x4f, 0x4e, 0x10, 0x06, 0x12, 0x11, 0x0a, 0x0d, 0x4c,
+	0x49, 0x53, 0x54, 0x45, 0x4e, 0x5f, 0x46, 0x41, 0x49, 0x4c, 0x45, 0x44, 0x10, 0x07, 0x42, 0x10,
+	0x5a, 0x0e, 0x2f, 0x65, 0x6d, 0x69, 0x73, 0x73, 0x61, 0x72, 0x79, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -124,16 +304,20 @@ func file_emissary_proto_rawDescGZIP() []byte {
 	return file_emissary_proto_rawDescData
 }
 
-var file_emissary_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_emissary_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_emissary_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
 var file_emissary_proto_goTypes = []interface{}{
-	(*ServerConnect)(nil), // 0: emissaryproto.ServerConnect
+	(HandshakeError_Reason)(0), // 0: emissaryproto.HandshakeError.Reason
+	(*ServerConnect)(nil),      // 1: emissaryproto.ServerConnect
+	(*HandshakeError)(nil),     // 2: emissaryproto.HandshakeError
 }
 var file_emissary_proto_depIdxs = []int32{
-	0, // [0:0] is the sub-list for method output_type
-	0, // [0:0] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	0, // 0: emissaryproto.HandshakeError.reason:type_name -> emissaryproto.HandshakeError.Reason
+	1, // [1:1] is the sub-list for method output_type
+	1, // [1:1] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
 }
 
 func init() { file_emissary_proto_init() }
@@ -154,19 +338,32 @@ func file_emissary_proto_init() {
 				return nil
 			}
 		}
+		file_emissary_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*HandshakeError); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_emissary_proto_rawDesc,
-			NumEnums:      0,
-			NumMessages:   1,
+			NumEnums:      1,
+			NumMessages:   2,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
 		GoTypes:           file_emissary_proto_goTypes,
 		DependencyIndexes: file_emissary_proto_depIdxs,
+		EnumInfos:         file_emissary_proto_enumTypes,
 		MessageInfos:      file_emissary_proto_msgTypes,
 	}.Build()
 	File_emissary_proto = out.File
@@ -0,0 +1,89 @@
+package emissaryproto
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/cockroachdb/errors"
+	"google.golang.org/protobuf/proto"
+)
+
+// MaxHandshakeErrorSize is the largest handshake error message we will read
+const MaxHandshakeErrorSize = 4096
+
+// handshakeErrorMagic starts a handshake error message. SOCKS5 clients stop reading a failed reply before its bound
+// address, so the reader skips anything before the magic, up to maxSkippedReplyBytes.
+var handshakeErrorMagic = []byte{'E', 'M'}
+
+// maxSkippedReplyBytes is the longest bound address a SOCKS5 reply could have, being a 255 byte domain name,
+// its length and a port
+const maxSkippedReplyBytes = 1 + 255 + 2
+
+// WriteHandshakeError tells the client why its handshake was rejected.
+//
+// The message is written after the rejection the client is waiting for (such as a SOCKS5 reply), prefixed with a
+// magic and its length as a big endian uint16. Clients which don't know about it close the connection without
+// reading it.
+func WriteHandshakeError(w io.Writer, reason HandshakeError_Reason, message string) error {
+	bytes, err := proto.Marshal(&HandshakeError{Reason: reason, Message: message})
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal handshake error")
+	}
+	if len(bytes) > MaxHandshakeErrorSize {
+		return errors.New("handshake error too long")
+	}
+
+	buf := make([]byte, len(handshakeErrorMagic)+2, len(handshakeErrorMagic)+2+len(bytes))
+	copy(buf, handshakeErrorMagic)
+	binary.BigEndian.PutUint16(buf[len(handshakeErrorMagic):], uint16(len(bytes)))
+	buf = append(buf, bytes...)
+
+	if _, err := w.Write(buf); err != nil {
+		return errors.Wrap(err, "unable to write handshake error")
+	}
+	return nil
+}
+
+// ReadHandshakeError reads the message written by WriteHandshakeError.
+func ReadHandshakeError(r io.Reader) (*HandshakeError, error) {
+	// Skip the rest of the SOCKS5 reply, reading one byte at a time so we don't read past the magic
+	matched := 0
+	b := []byte{0}
+	for skipped := 0; matched < len(handshakeErrorMagic); skipped++ {
+		if skipped > maxSkippedReplyBytes+len(handshakeErrorMagic) {
+			return nil, errors.New("no handshake error sent")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, errors.Wrap(err, "unable to read handshake error magic")
+		}
+
+		switch {
+		case b[0] == handshakeErrorMagic[matched]:
+			matched++
+		case b[0] == handshakeErrorMagic[0]:
+			matched = 1
+		default:
+			matched = 0
+		}
+	}
+
+	header := []byte{0, 0}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.Wrap(err, "unable to read handshake error header")
+	}
+	size := binary.BigEndian.Uint16(header)
+	if size > MaxHandshakeErrorSize {
+		return nil, errors.Newf("handshake error too long: %d bytes", size)
+	}
+
+	bytes := make([]byte, size)
+	if _, err := io.ReadFull(r, bytes); err != nil {
+		return nil, errors.Wrap(err, "unable to read handshake error")
+	}
+
+	msg := &HandshakeError{}
+	if err := proto.Unmarshal(bytes, msg); err != nil {
+		return nil, errors.Wrap(err, "unable to unmarshal handshake error")
+	}
+	return msg, nil
+}
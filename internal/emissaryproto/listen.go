@@ -0,0 +1,113 @@
+package emissaryproto
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/cockroachdb/errors"
+)
+
+// Within a multiplexed session, a stream can also start with a listen request, asking the server to listen on an
+// address within its network and forward the connections it accepts back to the client. ListenCommand is the first
+// byte of such a stream, matching the SOCKS5 BIND command, and can never be confused with SOCKS5Version.
+//
+// The server replies with a ListenResult, followed by the address it is listening on if it accepted the request, or
+// a HandshakeError if it rejected it. The listen stream then stays open for as long as the server is listening, and
+// either side closes it to stop listening.
+//
+// For each connection it accepts, the server opens a new stream within the session back to the client, which starts
+// with a ForwardedConn header naming the listen stream it was accepted for and who it was accepted from, after which
+// the stream carries the connection's data.
+const ListenCommand = 0x02
+
+// The results of a listen request
+const (
+	ListenSuccess = 0x00
+	ListenFailure = 0x01
+)
+
+// WriteListen asks the server to listen on the address.
+func WriteListen(w io.Writer, host string, port int) error {
+	return errors.Wrap(writeTargetRequest(w, ListenCommand, host, port), "unable to write listen request")
+}
+
+// ReadListen reads the request written by WriteListen.
+func ReadListen(r io.Reader) (host string, port int, err error) {
+	host, port, err = readTargetRequest(r, ListenCommand)
+	return host, port, errors.Wrap(err, "unable to read listen request")
+}
+
+// WriteListenResult tells the client whether its listen request was accepted, and if so the address the server
+// is listening on.
+func WriteListenResult(w io.Writer, result byte, addr string) error {
+	if len(addr) > 255 {
+		return errors.New("listen address too long")
+	}
+
+	buf := []byte{result}
+	if result == ListenSuccess {
+		buf = append(buf, byte(len(addr)))
+		buf = append(buf, addr...)
+	}
+	if _, err := w.Write(buf); err != nil {
+		return errors.Wrap(err, "unable to write listen result")
+	}
+	return nil
+}
+
+// ReadListenResult reads the servers response to a listen request.
+func ReadListenResult(r io.Reader) (result byte, addr string, err error) {
+	header := []byte{0}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", errors.Wrap(err, "unable to read listen result")
+	}
+	if header[0] != ListenSuccess {
+		return header[0], "", nil
+	}
+
+	addr, err = readString(r)
+	return header[0], addr, errors.Wrap(err, "unable to read listen address")
+}
+
+// WriteForwardedConn starts a stream carrying a connection the server accepted on the listen stream with the given
+// ID, from the remote address.
+func WriteForwardedConn(w io.Writer, listenerID uint32, remoteAddr string) error {
+	if len(remoteAddr) > 255 {
+		return errors.New("forwarded connection address too long")
+	}
+
+	buf := make([]byte, 5, 5+len(remoteAddr))
+	binary.BigEndian.PutUint32(buf, listenerID)
+	buf[4] = byte(len(remoteAddr))
+	buf = append(buf, remoteAddr...)
+
+	if _, err := w.Write(buf); err != nil {
+		return errors.Wrap(err, "unable to write forwarded connection header")
+	}
+	return nil
+}
+
+// ReadForwardedConn reads the header written by WriteForwardedConn.
+func ReadForwardedConn(r io.Reader) (listenerID uint32, remoteAddr string, err error) {
+	header := []byte{0, 0, 0, 0}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", errors.Wrap(err, "unable to read forwarded connection header")
+	}
+
+	remoteAddr, err = readString(r)
+	return binary.BigEndian.Uint32(header), remoteAddr, errors.Wrap(err, "unable to read forwarded connection address")
+}
+
+// readString reads a string prefixed with its length as a single byte
+func readString(r io.Reader) (string, error) {
+	length := []byte{0}
+	if _, err := io.ReadFull(r, length); err != nil {
+		return "", err //nolint:wrapcheck
+	}
+
+	str := make([]byte, length[0])
+	if _, err := io.ReadFull(r, str); err != nil {
+		return "", err //nolint:wrapcheck
+	}
+	return string(str), nil
+}
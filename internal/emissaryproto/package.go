@@ -8,10 +8,41 @@ var EmissaryServerVersion = "devel"
 // EmissaryServer is a constant and allows the client to sanity check it's connected to the correct thing
 const EmissaryServer = "emissary-server"
 
-// ProtocolVersion allows us forwards compatibility if we redesign the protocol in the future
+// ProtocolVersion allows us forwards compatibility if we redesign the protocol in the future. It is the highest
+// version we support; servers advertise the range of versions they support and clients pick the highest version
+// both sides support.
 //
 // Versions:
 // 1 = SOCKS5 proxy server is available after the connection message is sent by the server
-const ProtocolVersion = 1
+// 2 = After the connection message the client may either speak SOCKS5 directly (as per version 1), or authenticate the
+// transport once with a session auth message and then multiplex many SOCKS5 streams over it using yamux
+const ProtocolVersion = 2
+
+// LegacyProtocolVersion is the protocol version where a transport carries a single SOCKS5 stream.
+//
+// Clients from before version negotiation require the protocol_version field to exactly match the one version they
+// support, so servers always send this in it and advertise the versions they actually support as a range.
+const LegacyProtocolVersion = 1
+
+// MinProtocolVersion is the lowest protocol version we support
+const MinProtocolVersion = 1
+
+// The optional features a server can advertise it supports in the connect message
+const (
+	FeatureSessions        = "sessions"         // Authenticated transports can carry a multiplexed session
+	FeatureHandshakeErrors = "handshake_errors" // Rejected handshakes are followed by a HandshakeError message
+	FeatureUDP             = "udp"              // Streams within a session can tunnel datagrams to a UDP target
+	FeatureListen          = "listen"           // Streams within a session can ask the server to listen for connections
+)
+
+// HasFeature reports if the server advertised it supports the feature
+func (x *ServerConnect) HasFeature(feature string) bool {
+	for _, f := range x.GetFeatures() {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
 
 const NonceSize = 32
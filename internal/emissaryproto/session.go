@@ -0,0 +1,89 @@
+package emissaryproto
+
+import (
+	"io"
+
+	"github.com/cockroachdb/errors"
+)
+
+// The session auth message reuses the RFC 1929 username/password sub-negotiation format, which is
+// self-delimiting and so works over any stream transport. Its version byte can never be confused with
+// the first byte of a SOCKS5 greeting, which allows the server to tell protocol version 1 and 2 clients apart.
+const (
+	SessionAuthVersion = 0x01
+	SOCKS5Version      = 0x05
+)
+
+// SessionAuthStatus is the servers response to a session auth message
+type SessionAuthStatus byte
+
+const (
+	SessionAuthSuccess      SessionAuthStatus = 0x00
+	SessionAuthFailure      SessionAuthStatus = 0x01 // The credentials were not valid
+	SessionAuthClockSkew    SessionAuthStatus = 0x02 // The credentials were valid, but signed too far from the server's clock
+	SessionAuthReplayed     SessionAuthStatus = 0x03 // The credentials have already been used
+	SessionAuthUnknownKeyID SessionAuthStatus = 0x04 // The credentials were signed by a key the server does not know about
+)
+
+// WriteSessionAuth writes the session auth message for a multiplexed (protocol version 2) session.
+func WriteSessionAuth(w io.Writer, date, signature string) error {
+	if len(date) > 255 || len(signature) > 255 {
+		return errors.New("session auth credentials too long")
+	}
+
+	buf := make([]byte, 0, 3+len(date)+len(signature))
+	buf = append(buf, SessionAuthVersion, byte(len(date)))
+	buf = append(buf, date...)
+	buf = append(buf, byte(len(signature)))
+	buf = append(buf, signature...)
+
+	if _, err := w.Write(buf); err != nil {
+		return errors.Wrap(err, "unable to write session auth")
+	}
+	return nil
+}
+
+// ReadSessionAuth reads the session auth message written by WriteSessionAuth.
+func ReadSessionAuth(r io.Reader) (date, signature string, err error) {
+	header := []byte{0, 0}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", "", errors.Wrap(err, "unable to read session auth header")
+	}
+	if header[0] != SessionAuthVersion {
+		return "", "", errors.Newf("unsupported session auth version: %d", header[0])
+	}
+
+	dateBytes := make([]byte, int(header[1])+1)
+	if _, err := io.ReadFull(r, dateBytes); err != nil {
+		return "", "", errors.Wrap(err, "unable to read session auth date")
+	}
+
+	sigBytes := make([]byte, dateBytes[len(dateBytes)-1])
+	if _, err := io.ReadFull(r, sigBytes); err != nil {
+		return "", "", errors.Wrap(err, "unable to read session auth signature")
+	}
+
+	return string(dateBytes[:len(dateBytes)-1]), string(sigBytes), nil
+}
+
+// WriteSessionAuthResult tells the client whether its session auth message was accepted.
+func WriteSessionAuthResult(w io.Writer, status SessionAuthStatus) error {
+	if _, err := w.Write([]byte{SessionAuthVersion, byte(status)}); err != nil {
+		return errors.Wrap(err, "unable to write session auth result")
+	}
+	return nil
+}
+
+// ReadSessionAuthResult reads the servers response to the session auth message.
+//
+// Clients should treat any status other than SessionAuthSuccess as a failure, including ones they don't know about.
+func ReadSessionAuthResult(r io.Reader) (SessionAuthStatus, error) {
+	result := []byte{0, 0}
+	if _, err := io.ReadFull(r, result); err != nil {
+		return 0, errors.Wrap(err, "unable to read session auth result")
+	}
+	if result[0] != SessionAuthVersion {
+		return 0, errors.Newf("unsupported session auth version: %d", result[0])
+	}
+	return SessionAuthStatus(result[1]), nil
+}
@@ -0,0 +1,125 @@
+package emissaryproto
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/cockroachdb/errors"
+)
+
+// Within a multiplexed session, a stream either starts with a SOCKS5 greeting to tunnel a TCP connection, or with a
+// UDP associate request to tunnel datagrams to a single UDP target. UDPAssociateCommand is the first byte of the
+// latter, matching the SOCKS5 UDP ASSOCIATE command, and can never be confused with SOCKS5Version.
+//
+// The server replies with a UDPAssociateResult, followed by a HandshakeError if it rejected the request. Once
+// accepted, each datagram is sent in either direction prefixed with its length as a big endian uint16.
+const UDPAssociateCommand = 0x03
+
+// The results of a UDP associate request
+const (
+	UDPAssociateSuccess = 0x00
+	UDPAssociateFailure = 0x01
+)
+
+// MaxDatagramSize is the largest datagram which can be tunnelled
+const MaxDatagramSize = 0xFFFF
+
+// WriteUDPAssociate asks the server to tunnel datagrams to the target.
+func WriteUDPAssociate(w io.Writer, host string, port int) error {
+	return errors.Wrap(writeTargetRequest(w, UDPAssociateCommand, host, port), "unable to write udp associate request")
+}
+
+// ReadUDPAssociate reads the request written by WriteUDPAssociate.
+func ReadUDPAssociate(r io.Reader) (host string, port int, err error) {
+	host, port, err = readTargetRequest(r, UDPAssociateCommand)
+	return host, port, errors.Wrap(err, "unable to read udp associate request")
+}
+
+// writeTargetRequest writes a request which starts a stream, made up of the command byte followed by the
+// length prefixed host and then the port as a big endian uint16.
+func writeTargetRequest(w io.Writer, command byte, host string, port int) error {
+	if len(host) > 255 {
+		return errors.New("host too long")
+	}
+
+	buf := make([]byte, 2, 4+len(host))
+	buf[0], buf[1] = command, byte(len(host))
+	buf = append(buf, host...)
+	buf = append(buf, byte(port>>8), byte(port))
+
+	_, err := w.Write(buf)
+	return err //nolint:wrapcheck
+}
+
+// readTargetRequest reads the request written by writeTargetRequest, checking it is for the expected command.
+func readTargetRequest(r io.Reader, command byte) (host string, port int, err error) {
+	header := []byte{0, 0}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", 0, errors.Wrap(err, "unable to read header")
+	}
+	if header[0] != command {
+		return "", 0, errors.Newf("unexpected command: %d", header[0])
+	}
+
+	target := make([]byte, int(header[1])+2)
+	if _, err := io.ReadFull(r, target); err != nil {
+		return "", 0, errors.Wrap(err, "unable to read target")
+	}
+
+	return string(target[:header[1]]), int(binary.BigEndian.Uint16(target[header[1]:])), nil
+}
+
+// WriteUDPAssociateResult tells the client whether its UDP associate request was accepted.
+func WriteUDPAssociateResult(w io.Writer, result byte) error {
+	if _, err := w.Write([]byte{result}); err != nil {
+		return errors.Wrap(err, "unable to write udp associate result")
+	}
+	return nil
+}
+
+// ReadUDPAssociateResult reads the servers response to a UDP associate request.
+func ReadUDPAssociateResult(r io.Reader) (byte, error) {
+	result := []byte{0}
+	if _, err := io.ReadFull(r, result); err != nil {
+		return 0, errors.Wrap(err, "unable to read udp associate result")
+	}
+	return result[0], nil
+}
+
+// WriteDatagram writes a single datagram to a UDP associate stream.
+func WriteDatagram(w io.Writer, datagram []byte) error {
+	if len(datagram) > MaxDatagramSize {
+		return errors.Newf("datagram too long: %d bytes", len(datagram))
+	}
+
+	buf := make([]byte, 2, 2+len(datagram))
+	binary.BigEndian.PutUint16(buf, uint16(len(datagram)))
+	buf = append(buf, datagram...)
+
+	if _, err := w.Write(buf); err != nil {
+		return errors.Wrap(err, "unable to write datagram")
+	}
+	return nil
+}
+
+// ReadDatagram reads a single datagram from a UDP associate stream into p. As with a UDP socket, if the datagram
+// is larger than p, the rest of it is discarded.
+func ReadDatagram(r io.Reader, p []byte) (int, error) {
+	header := []byte{0, 0}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err //nolint:wrapcheck
+	}
+	size := int(binary.BigEndian.Uint16(header))
+
+	n := size
+	if n > len(p) {
+		n = len(p)
+	}
+	if _, err := io.ReadFull(r, p[:n]); err != nil {
+		return 0, errors.Wrap(err, "unable to read datagram")
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(size-n)); err != nil {
+		return 0, errors.Wrap(err, "unable to read datagram")
+	}
+	return n, nil
+}
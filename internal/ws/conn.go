@@ -3,6 +3,7 @@ package ws
 import (
 	"io"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
@@ -13,11 +14,66 @@ import (
 	"go.uber.org/atomic"
 )
 
+// HalfCloseSubprotocol is the websocket subprotocol both sides use to say they understand half-close, where a text
+// message tells the peer we've finished writing. Data is only ever sent in binary messages, so a text message can never
+// be mistaken for it.
+//
+// It implies the connect message is framed, as websockets only pick one subprotocol, so clients should ask for it
+// ahead of emissaryproto.FramedConnectSubprotocol.
+const HalfCloseSubprotocol = "emissary.half-close"
+
+// WriteBufferPool is shared by every websocket we dial or accept, so a connection only holds a write buffer while it
+// is writing a message, rather than for as long as it is open
+var WriteBufferPool websocket.BufferPool = &sync.Pool{}
+
+// DefaultCoalesceSize is how much data is coalesced into one message before it is sent without waiting for the flush
+// delay, if WriteOptions.MaxFrameSize isn't set
+const DefaultCoalesceSize = 32 * 1024
+
+// WriteOptions configures how writes are sent as websocket messages. The zero value sends each write as one message
+// straight away.
+type WriteOptions struct {
+	// FlushDelay is how long a write waits for more writes to be coalesced into the same message, so chatty protocols
+	// don't send a message for every small write. Zero sends each write straight away.
+	FlushDelay time.Duration
+
+	// MaxFrameSize is the largest message a write is sent as, with larger writes split across many. Zero never
+	// splits writes.
+	MaxFrameSize int
+}
+
+// DeflateExtension is the websocket extension which compresses messages, see RFC 7692
+const DeflateExtension = "permessage-deflate"
+
+// DeflateNegotiated reports if the headers of a websocket handshake offer, or accept, compressing messages
+func DeflateNegotiated(header http.Header) bool {
+	for _, extensions := range header.Values("Sec-Websocket-Extensions") {
+		for _, extension := range strings.Split(extensions, ",") {
+			name := strings.SplitN(extension, ";", 2)[0]
+			if strings.EqualFold(strings.TrimSpace(name), DeflateExtension) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 type Conn struct {
-	conn   *websocket.Conn
-	buff   []byte
-	r      sync.Mutex
-	closed *atomic.Bool
+	conn        *websocket.Conn
+	options     WriteOptions
+	compressed  bool      // if the messages we write are compressed
+	reader      io.Reader // the message currently being read, guarded by r
+	r           sync.Mutex
+	w           sync.Mutex
+	closed      *atomic.Bool
+	done        chan struct{} // closed once the connection is closed
+	halfClose   bool          // if the peer understands half-close
+	readClosed  bool          // guarded by r
+	writeClosed bool          // guarded by w
+	pending     []byte        // data waiting to be coalesced into the next message, guarded by w
+	flushTimer  *time.Timer   // flushes pending once the flush delay passes, guarded by w
+	flushing    bool          // if flushTimer is running, guarded by w
+	writeErr    error         // why the last flush failed, returned by the next write or close, guarded by w
 }
 
 var _ net.Conn = (*Conn)(nil)
@@ -25,61 +81,221 @@ var _ net.Conn = (*Conn)(nil)
 const WriteTimeout = 10 * time.Second
 
 func NewClient(conn *websocket.Conn) *Conn {
+	return NewClientWithOptions(conn, WriteOptions{})
+}
+
+// NewClientWithOptions wraps the websocket, sending writes as configured by the options.
+func NewClientWithOptions(conn *websocket.Conn, options WriteOptions) *Conn {
 	return &Conn{
-		conn:   conn,
-		buff:   nil,
-		closed: atomic.NewBool(false),
+		conn:      conn,
+		options:   options,
+		closed:    atomic.NewBool(false),
+		done:      make(chan struct{}),
+		halfClose: conn.Subprotocol() == HalfCloseSubprotocol,
 	}
 }
 
+// EnableCompression compresses the messages we write at the flate level, from flate.HuffmanOnly to
+// flate.BestCompression. It must only be called once the handshake has negotiated the DeflateExtension.
+func (c *Conn) EnableCompression(level int) error {
+	if err := c.conn.SetCompressionLevel(level); err != nil {
+		return errors.Wrapf(err, "invalid compression level %d", level)
+	}
+	c.conn.EnableWriteCompression(true)
+	c.compressed = true
+	return nil
+}
+
+// Compressed reports if the messages we write are compressed
+func (c *Conn) Compressed() bool {
+	return c.compressed
+}
+
+// Read streams the current message straight into dst, starting the next message once it has all been read.
+//
+// Like reading a net.Conn, a read returns whatever of the message has arrived rather than waiting to fill dst, and
+// never spans two messages.
 func (c *Conn) Read(dst []byte) (int, error) {
 	c.r.Lock()
 	defer c.r.Unlock()
 
-	// use buffer or read new message
-	var src []byte
-	if len(c.buff) > 0 {
-		src = c.buff
-		c.buff = nil
-	} else if _, msg, err := c.conn.ReadMessage(); err == nil {
-		src = msg
-	} else {
-		if websocket.IsCloseError(err, websocket.CloseNormalClosure) || strings.HasSuffix(err.Error(), "use of closed network connection") {
+	if len(dst) == 0 {
+		return 0, nil
+	}
+
+	for {
+		if c.readClosed {
 			return 0, io.EOF
 		}
 
-		return 0, errors.Wrap(err, "unable to read socket")
+		if c.reader == nil {
+			msgType, reader, err := c.conn.NextReader()
+			if err != nil {
+				return 0, readError(err)
+			}
+
+			// The peer has finished writing, but may still be reading what we write
+			if msgType == websocket.TextMessage && c.halfClose {
+				c.readClosed = true
+				continue
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(dst)
+		if errors.Is(err, io.EOF) {
+			// We've read the rest of the message, so the next read starts the next message
+			c.reader = nil
+		} else if err != nil {
+			return n, readError(err)
+		}
+
+		// An empty message has nothing to return, so read the next
+		if n > 0 {
+			return n, nil
+		}
 	}
+}
 
-	// copy src->dest
-	var n int
-	if ldst := len(dst); len(src) > ldst {
-		// copy as much as possible of src into dst
-		n = copy(dst, src[:ldst])
-		// copy remainder into buffer
-		r := src[ldst:]
-		lr := len(r)
-		c.buff = make([]byte, lr)
-		copy(c.buff, r)
-	} else {
-		// copy all of src into dst
-		n = copy(dst, src)
+// readError returns io.EOF if the websocket was closed normally, otherwise the error
+func readError(err error) error {
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure) || strings.HasSuffix(err.Error(), "use of closed network connection") {
+		return io.EOF
 	}
 
-	// return bytes copied
-	return n, nil
+	return errors.Wrap(err, "unable to read socket")
 }
 
-func (c *Conn) Write(b []byte) (n int, err error) {
-	err = c.conn.WriteMessage(websocket.BinaryMessage, b)
-	if err != nil {
-		return 0, errors.Wrap(err, "unable to write data")
+// Write sends the data as a binary message, split into messages of at most the max frame size. With a flush delay,
+// the data is instead held briefly to be coalesced with following writes; if sending it fails, the connection is
+// closed so reads fail too, and the error is returned by the next write or Close.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.w.Lock()
+	defer c.w.Unlock()
+
+	if c.writeClosed {
+		return 0, errors.Wrap(net.ErrClosed, "unable to write data after close write")
+	}
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+
+	if c.options.FlushDelay <= 0 {
+		return c.writeMessages(b)
+	}
+
+	// Wait for more writes until the flush delay, unless there's already enough for a full message
+	limit := c.options.MaxFrameSize
+	if limit <= 0 {
+		limit = DefaultCoalesceSize
+	}
+	if len(c.pending)+len(b) < limit {
+		c.pending = append(c.pending, b...)
+		if !c.flushing {
+			c.flushing = true
+			if c.flushTimer == nil {
+				c.flushTimer = time.AfterFunc(c.options.FlushDelay, c.flush)
+			} else {
+				c.flushTimer.Reset(c.options.FlushDelay)
+			}
+		}
+		return len(b), nil
 	}
-	return len(b), nil
+
+	// Top up anything pending to a full message, then send the rest of the write without copying it
+	written := 0
+	if len(c.pending) > 0 {
+		n := limit - len(c.pending)
+		c.pending = append(c.pending, b[:n]...)
+		if err := c.flushPending(); err != nil {
+			return 0, err
+		}
+		written = n
+	}
+	n, err := c.writeMessages(b[written:])
+	return written + n, err
+}
+
+// flush sends the pending data once the flush delay has passed
+func (c *Conn) flush() {
+	c.w.Lock()
+	defer c.w.Unlock()
+
+	c.flushing = false
+	if err := c.flushPending(); err != nil && c.writeErr == nil {
+		// Nothing is waiting on the write to see it fail, so close the connection for reads to notice
+		c.writeErr = err
+		_ = c.conn.Close()
+	}
+}
+
+// stopFlushTimer stops the pending data being flushed by the timer, for it to be flushed straight away instead. The
+// caller must hold c.w.
+func (c *Conn) stopFlushTimer() {
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+	}
+	c.flushing = false
+}
+
+// flushPending sends any data waiting to be coalesced. The caller must hold c.w.
+func (c *Conn) flushPending() error {
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	_, err := c.writeMessages(c.pending)
+	c.pending = c.pending[:0]
+	return err
+}
+
+// writeMessages sends the data as binary messages of at most the max frame size, returning how much of it was sent.
+// The caller must hold c.w.
+func (c *Conn) writeMessages(b []byte) (int, error) {
+	size := c.options.MaxFrameSize
+	if size <= 0 || len(b) <= size {
+		if err := c.conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+			return 0, errors.Wrap(err, "unable to write data")
+		}
+		return len(b), nil
+	}
+
+	written := 0
+	for written < len(b) {
+		n := size
+		if len(b)-written < n {
+			n = len(b) - written
+		}
+		if err := c.conn.WriteMessage(websocket.BinaryMessage, b[written:written+n]); err != nil {
+			return written, errors.Wrap(err, "unable to write data")
+		}
+		written += n
+	}
+	return written, nil
 }
 
 func (c *Conn) Close() error {
 	if c.closed.CAS(false, true) {
+		defer close(c.done)
+
+		// Send what's waiting to be coalesced. A write blocked on a peer which isn't reading holds c.w, so bound how
+		// long we wait for it
+		deadline := time.Now().Add(WriteTimeout)
+		_ = c.conn.UnderlyingConn().SetWriteDeadline(deadline)
+		c.w.Lock()
+		c.stopFlushTimer()
+		_ = c.conn.SetWriteDeadline(deadline)
+		if err := c.flushPending(); err != nil && c.writeErr == nil {
+			c.writeErr = err
+		}
+		writeErr := c.writeErr
+		c.w.Unlock()
+
+		if writeErr != nil {
+			_ = c.conn.Close()
+			return writeErr
+		}
+
 		err := c.conn.WriteControl(
 			websocket.CloseMessage,
 			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "encore"),
@@ -97,8 +313,38 @@ func (c *Conn) Close() error {
 	return nil
 }
 
+// CloseWrite tells the peer we've finished writing, so its reads return io.EOF while it can still write to us. If the
+// peer doesn't understand half-close, the connection is closed completely.
 func (c *Conn) CloseWrite() error {
-	return c.Close()
+	if !c.halfClose {
+		return c.Close()
+	}
+
+	c.w.Lock()
+	defer c.w.Unlock()
+
+	if c.writeClosed {
+		return nil
+	}
+	c.writeClosed = true
+	c.stopFlushTimer()
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	if err := c.flushPending(); err != nil {
+		return err
+	}
+	return errors.Wrap(c.conn.WriteMessage(websocket.TextMessage, nil), "unable to send close write message")
+}
+
+// Done returns a channel which is closed once the connection is closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// UnderlyingConn returns the connection the websocket is running over.
+func (c *Conn) UnderlyingConn() net.Conn {
+	return c.conn.UnderlyingConn()
 }
 
 func (c *Conn) LocalAddr() net.Addr {
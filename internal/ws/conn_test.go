@@ -0,0 +1,292 @@
+package ws
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The sizes of the messages written, and the buffer they're read into, in each benchmark. io.Copy reads and writes
+// 32KiB at a time, but is often reading into something smaller, such as a database driver's buffer.
+var benchmarkSizes = []struct {
+	message, read int
+}{
+	{message: 512, read: 32 * 1024},
+	{message: 32 * 1024, read: 32 * 1024},
+	{message: 32 * 1024, read: 4 * 1024},
+	{message: 256 * 1024, read: 32 * 1024},
+}
+
+// TestConn_Read checks messages are streamed in order without a read spanning two messages, and empty messages are
+// skipped
+func TestConn_Read(t *testing.T) {
+	conn := mustServe(t, WriteOptions{}, func(conn *websocket.Conn) {
+		for _, msg := range []string{"hello", "", "world, this is longer"} {
+			if err := conn.WriteMessage(websocket.BinaryMessage, []byte(msg)); err != nil {
+				return
+			}
+		}
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	})
+	defer func() { _ = conn.Close() }()
+
+	var reads []string
+	buf := make([]byte, 8)
+	for {
+		n, err := conn.Read(buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("unable to read: %v", err)
+		}
+		reads = append(reads, string(buf[:n]))
+	}
+
+	expected := []string{"hello", "world, t", "his is l", "onger"}
+	if strings.Join(reads, "|") != strings.Join(expected, "|") {
+		t.Fatalf("expected reads %q, got %q", expected, reads)
+	}
+}
+
+// TestConn_Read_PartialMessage checks a read returns what has arrived of a message, rather than waiting for the rest
+// of it to fill the buffer
+func TestConn_Read_PartialMessage(t *testing.T) {
+	read := make(chan struct{})
+	conn := mustServe(t, WriteOptions{}, func(conn *websocket.Conn) {
+		w, err := conn.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			return
+		}
+		// More than the write buffer, so the start of the message is sent before the rest is written
+		_, _ = w.Write(make([]byte, 8*1024))
+		<-read
+		_ = w.Close()
+	})
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(make([]byte, 64*1024))
+	close(read)
+	if err != nil {
+		t.Fatalf("unable to read: %v", err)
+	}
+	if n == 0 || n >= 64*1024 {
+		t.Fatalf("expected to read part of the message, got %d bytes", n)
+	}
+}
+
+// TestConn_Write checks small writes are coalesced into one message within the flush delay, and large writes are split
+// into messages no larger than the max frame size
+func TestConn_Write(t *testing.T) {
+	received := make(chan []string, 1)
+	conn := mustServe(t, WriteOptions{FlushDelay: 50 * time.Millisecond, MaxFrameSize: 8}, func(conn *websocket.Conn) {
+		var messages []string
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				break
+			}
+			messages = append(messages, string(msg))
+		}
+		received <- messages
+	})
+
+	for _, write := range []string{"a", "b", "c", "defghijklmnopqrst", "u"} {
+		if _, err := conn.Write([]byte(write)); err != nil {
+			t.Fatalf("unable to write: %v", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := conn.Write([]byte("vw")); err != nil {
+		t.Fatalf("unable to write: %v", err)
+	}
+	_ = conn.Close()
+
+	expected := []string{"abcdefgh", "ijklmnop", "qrst", "u", "vw"}
+	if messages := <-received; strings.Join(messages, "|") != strings.Join(expected, "|") {
+		t.Fatalf("expected messages %q, got %q", expected, messages)
+	}
+}
+
+// TestConn_FlushError checks a coalesced write which fails to send once the flush delay has passed is reported by
+// Close, rather than lost because no write followed it
+func TestConn_FlushError(t *testing.T) {
+	conn := mustServe(t, WriteOptions{FlushDelay: 10 * time.Millisecond}, func(conn *websocket.Conn) {
+		_, _, _ = conn.ReadMessage()
+	})
+	_ = conn.UnderlyingConn().Close()
+
+	// The write is only held, so it can't fail until it's flushed
+	if _, err := conn.Write([]byte("lost")); err != nil {
+		t.Fatalf("unable to write: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if err := conn.Close(); err == nil || !strings.Contains(err.Error(), "unable to write data") {
+		t.Fatalf("expected close to return the flush error, got %v", err)
+	}
+}
+
+// BenchmarkConn_Read measures streaming messages straight into the read buffer
+func BenchmarkConn_Read(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("message=%d/read=%d", size.message, size.read), func(b *testing.B) {
+			benchmarkRead(b, size.message, size.read, func(conn *websocket.Conn) io.Reader { return NewClient(conn) })
+		})
+	}
+}
+
+// BenchmarkConn_ReadMessage measures reading whole messages and buffering what doesn't fit, as Conn used to
+func BenchmarkConn_ReadMessage(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("message=%d/read=%d", size.message, size.read), func(b *testing.B) {
+			benchmarkRead(b, size.message, size.read, func(conn *websocket.Conn) io.Reader { return &messageConn{conn: conn} })
+		})
+	}
+}
+
+// benchmarkRead reads b.N messages of messageSize from a websocket served locally, using a buffer of readSize
+func benchmarkRead(b *testing.B, messageSize, readSize int, reader func(conn *websocket.Conn) io.Reader) {
+	message := []byte(strings.Repeat("x", messageSize))
+	total := int64(b.N) * int64(messageSize)
+
+	conn := mustServe(b, WriteOptions{}, func(conn *websocket.Conn) {
+		for i := 0; i < b.N; i++ {
+			if err := conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+				return
+			}
+		}
+		// Wait for the client to read everything before closing
+		_, _, _ = conn.ReadMessage()
+	})
+	defer func() { _ = conn.Close() }()
+	r := reader(conn.conn)
+
+	b.SetBytes(int64(messageSize))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	buf := make([]byte, readSize)
+	var read int64
+	for read < total {
+		n, err := r.Read(buf)
+		if err != nil {
+			b.Fatalf("unable to read: %v", err)
+		}
+		read += int64(n)
+	}
+}
+
+// BenchmarkConn_Write measures sending many small writes, and a few large ones, with and without coalescing and
+// splitting them into bounded frames
+func BenchmarkConn_Write(b *testing.B) {
+	for _, bench := range []struct {
+		name      string
+		writeSize int
+		options   WriteOptions
+	}{
+		{name: "write=64", writeSize: 64},
+		{name: "write=64/flush=1ms", writeSize: 64, options: WriteOptions{FlushDelay: time.Millisecond}},
+		{name: "write=64/flush=1ms/frame=4096", writeSize: 64, options: WriteOptions{FlushDelay: time.Millisecond, MaxFrameSize: 4096}},
+		{name: "write=1048576", writeSize: 1024 * 1024},
+		{name: "write=1048576/frame=65536", writeSize: 1024 * 1024, options: WriteOptions{MaxFrameSize: 64 * 1024}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			benchmarkWrite(b, bench.writeSize, bench.options)
+		})
+	}
+}
+
+// benchmarkWrite writes b.N writes of writeSize to a websocket served locally, reporting how many messages each
+// write was sent as
+func benchmarkWrite(b *testing.B, writeSize int, options WriteOptions) {
+	data := []byte(strings.Repeat("x", writeSize))
+	total := int64(b.N) * int64(writeSize)
+
+	messages := make(chan int, 1)
+	conn := mustServe(b, options, func(conn *websocket.Conn) {
+		count := 0
+		var read int64
+		for read < total {
+			_, r, err := conn.NextReader()
+			if err != nil {
+				break
+			}
+			n, _ := io.Copy(io.Discard, r)
+			read += n
+			count++
+		}
+		messages <- count
+	})
+
+	b.SetBytes(int64(writeSize))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(data); err != nil {
+			b.Fatalf("unable to write: %v", err)
+		}
+	}
+	// Closing sends anything still waiting to be coalesced
+	_ = conn.Close()
+	count := <-messages
+
+	b.StopTimer()
+	b.ReportMetric(float64(count)/float64(b.N), "msgs/op")
+}
+
+// mustServe dials a websocket served locally by the handler, which is closed once the handler returns
+func mustServe(tb testing.TB, options WriteOptions, handler func(conn *websocket.Conn)) *Conn {
+	tb.Helper()
+
+	upgrader := websocket.Upgrader{WriteBufferPool: WriteBufferPool}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		handler(conn)
+	}))
+	tb.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		tb.Fatalf("unable to dial websocket: %v", err)
+	}
+	return NewClientWithOptions(conn, options)
+}
+
+// messageConn reads from a websocket the way Conn did before it streamed messages; reading each message whole, and
+// copying whatever doesn't fit into the read buffer into a new buffer for the next read
+type messageConn struct {
+	conn *websocket.Conn
+	buff []byte
+}
+
+func (c *messageConn) Read(dst []byte) (int, error) {
+	var src []byte
+	if len(c.buff) > 0 {
+		src = c.buff
+		c.buff = nil
+	} else if _, msg, err := c.conn.ReadMessage(); err == nil {
+		src = msg
+	} else {
+		return 0, err //nolint:wrapcheck
+	}
+
+	n := copy(dst, src)
+	if n < len(src) {
+		c.buff = make([]byte, len(src)-n)
+		copy(c.buff, src[n:])
+	}
+	return n, nil
+}
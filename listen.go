@@ -0,0 +1,201 @@
+package emissary
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/hashicorp/yamux"
+	"github.com/rs/zerolog/log"
+	"go.encore.dev/emissary/internal/emissaryproto"
+)
+
+// Listen asks the Emissary server to listen on the address within its network, returning a listener for the
+// connections the server accepts there, which are forwarded back to us through a multiplexed session. This allows
+// services within the private network to connect to us.
+//
+// The address must be allowed as a listen target by the server. The listener is closed if the session it was opened
+// within closes, such as when the Dialer is closed or the server shuts down.
+func (e *Dialer) Listen(ctx context.Context, addr string) (net.Listener, error) {
+	host, port, err := splitTargetAddr(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid listen address")
+	}
+
+	stream, session, legacy, err := e.newStream(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if legacy != nil {
+		_ = legacy.conn.Close()
+		return nil, errors.Wrap(ErrListenNotSupported, "server only supports protocol version 1")
+	}
+	if !session.connectMessage.HasFeature(emissaryproto.FeatureListen) {
+		_ = stream.Close()
+		return nil, ErrListenNotSupported
+	}
+
+	// Register the listener before asking the server to listen, so we're ready for the first connection it forwards
+	l := &listener{
+		session: session,
+		stream:  stream,
+		addr:    &targetAddr{network: "tcp", addr: addr},
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	session.addListener(stream.StreamID(), l)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	if err := emissaryproto.WriteListen(stream, host, port); err != nil {
+		_ = l.Close()
+		return nil, err //nolint:wrapcheck
+	}
+	result, boundAddr, err := emissaryproto.ReadListenResult(stream)
+	if err != nil {
+		_ = l.Close()
+		return nil, err //nolint:wrapcheck
+	}
+	if result != emissaryproto.ListenSuccess {
+		err := readHandshakeError(ctx, stream)
+		if err == nil {
+			err = errors.New("emissary server rejected the listen request")
+		}
+		_ = l.Close()
+		return nil, errors.Wrap(err, "unable to listen")
+	}
+	_ = stream.SetDeadline(time.Time{})
+
+	if tcpAddr, err := net.ResolveTCPAddr("tcp", boundAddr); err == nil {
+		l.addr = tcpAddr
+	}
+	log.Debug().Str("addr", l.addr.String()).Msg("emissary server is listening")
+
+	go l.watch()
+	return l, nil
+}
+
+// listener receives the connections the server accepts on an address, for as long as the listen stream is open
+type listener struct {
+	session *session
+	stream  *sessionStream
+	addr    net.Addr
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ net.Listener = (*listener)(nil)
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+// Close tells the server to stop listening. Connections which have already been accepted are left open.
+func (l *listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.session.removeListener(l.stream.StreamID())
+		err = l.stream.Close()
+	})
+	return errors.Wrap(err, "unable to close listen stream")
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+// watch closes the listener once the server closes the listen stream, such as when it is shutting down
+func (l *listener) watch() {
+	_, _ = io.Copy(io.Discard, l.stream)
+	_ = l.Close()
+}
+
+// deliver hands a forwarded connection to Accept, or closes it if the listener is closed first
+func (l *listener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		_ = conn.Close()
+	}
+}
+
+// addListener registers the listener for the connections forwarded to the listen stream with the given ID, and
+// starts accepting the streams the server opens to forward them.
+func (s *session) addListener(id uint32, l *listener) {
+	s.mu.Lock()
+	if s.listeners == nil {
+		s.listeners = make(map[uint32]*listener)
+	}
+	s.listeners[id] = l
+	s.mu.Unlock()
+
+	s.acceptOnce.Do(func() { go s.acceptForwarded() })
+}
+
+func (s *session) removeListener(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.listeners, id)
+}
+
+// acceptForwarded accepts the streams the server opens to forward connections to our listeners, until the
+// session closes.
+func (s *session) acceptForwarded() {
+	for {
+		stream, err := s.AcceptStream()
+		if err != nil {
+			return
+		}
+		go s.forward(stream)
+	}
+}
+
+// forward reads which listener a stream was opened for, and hands it over to that listener
+func (s *session) forward(stream *yamux.Stream) {
+	_ = stream.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	id, remote, err := emissaryproto.ReadForwardedConn(stream)
+	if err != nil {
+		log.Debug().Err(err).Msg("unable to read forwarded emissary connection")
+		_ = stream.Close()
+		return
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+
+	s.mu.Lock()
+	l := s.listeners[id]
+	s.mu.Unlock()
+	if l == nil {
+		log.Debug().Uint32("listener", id).Msg("emissary server forwarded a connection for a closed listener")
+		_ = stream.Close()
+		return
+	}
+
+	conn := &forwardedConn{sessionStream: &sessionStream{stream}, local: l.addr, remote: &targetAddr{network: "tcp", addr: remote}}
+	if tcpAddr, err := net.ResolveTCPAddr("tcp", remote); err == nil {
+		conn.remote = tcpAddr
+	}
+	l.deliver(conn)
+}
+
+// forwardedConn is a connection the server accepted on one of our listeners, addressed as the server saw it
+type forwardedConn struct {
+	*sessionStream
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *forwardedConn) LocalAddr() net.Addr  { return c.local }
+func (c *forwardedConn) RemoteAddr() net.Addr { return c.remote }
@@ -0,0 +1,121 @@
+// Package audit records a structured event for every tunnel opened through the Emissary server, so there is a
+// single record of who connected to what, and for how long.
+package audit
+
+import (
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Decision records what the server decided to do with a tunnel
+type Decision string
+
+const (
+	DecisionAllowed          Decision = "allowed"           // The tunnel was opened to the target
+	DecisionDenied           Decision = "denied"            // The target is not allowed for the client
+	DecisionForbiddenNetwork Decision = "forbidden_network" // The target resolved into a forbidden network
+	DecisionDialFailed       Decision = "dial_failed"       // The target was allowed, but could not be connected to
+	DecisionListenFailed     Decision = "listen_failed"     // The target was allowed, but could not be listened on
+	DecisionUnauthenticated  Decision = "unauthenticated"   // The client did not authenticate
+	DecisionIncomplete       Decision = "incomplete"        // The client authenticated, but never asked for a target
+)
+
+// Event is the audit record of a single tunnel, emitted when it closes
+type Event struct {
+	KeyID          *uint32   `json:"key_id,omitempty"`          // The ID of the auth key the client used
+	ClientIdentity string    `json:"client_identity,omitempty"` // The identity from the client's certificate, if it used one
+	RemoteAddr     string    `json:"remote_addr"`
+	Transport      string    `json:"transport"`
+	Network        string    `json:"network"`               // The network of the target, tcp or udp
+	Listen         bool      `json:"listen,omitempty"`      // True if the client asked to listen on the target, rather than connect to it
+	Target         string    `json:"target,omitempty"`      // The target as requested by the client
+	ResolvedIP     string    `json:"resolved_ip,omitempty"` // The IP the target resolved to
+	Decision       Decision  `json:"decision"`
+	BytesIn        int64     `json:"bytes_in"`  // Bytes received from the target
+	BytesOut       int64     `json:"bytes_out"` // Bytes sent to the target
+	Start          time.Time `json:"start"`
+	End            time.Time `json:"end"`
+	CloseReason    string    `json:"close_reason"`
+}
+
+// Sink is somewhere audit events are written to.
+//
+// Writing an event must not block the tunnel it's for, so sinks report their own errors.
+type Sink interface {
+	Write(event *Event)
+	Close() error
+}
+
+// The defaults for rotating an audit log file
+const (
+	DefaultMaxSizeMB  = 100
+	DefaultMaxBackups = 10
+)
+
+// NewSink creates the sink described by the given URL:
+//   - `stdout`, to write events to stdout as JSON lines, which the server's logs are kept off
+//   - `file:///path/to/audit.log`, to write JSON lines to a file which is rotated once it reaches `max_size_mb`
+//     (default 100), keeping `max_backups` old files (default 10), such as `file:///var/log/audit.log?max_backups=5`
+//   - `http://` or `https://`, to POST each event as JSON to a webhook
+//
+// An empty string means audit events are not recorded, and a nil Sink is returned.
+func NewSink(sink string) (Sink, error) {
+	if sink == "" {
+		return nil, nil //nolint:nilnil
+	}
+	if sink == "stdout" {
+		// The server logs to stderr, so stdout only carries audit events, and it isn't ours to close
+		return newWriterSink(uncloseable{os.Stdout}), nil
+	}
+
+	u, err := url.Parse(sink)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse audit log sink")
+	}
+
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, errors.Newf("no path given for audit log file: %s", sink)
+		}
+
+		maxSize, err := intParam(u, "max_size_mb", DefaultMaxSizeMB)
+		if err != nil {
+			return nil, err
+		}
+		maxBackups, err := intParam(u, "max_backups", DefaultMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+
+		return newWriterSink(&lumberjack.Logger{
+			Filename:   u.Path,
+			MaxSize:    maxSize,
+			MaxBackups: maxBackups,
+		}), nil
+
+	case "http", "https":
+		return newWebhookSink(sink), nil
+
+	default:
+		return nil, errors.Newf("unsupported audit log sink: %s", sink)
+	}
+}
+
+func intParam(u *url.URL, name string, defaultValue int) (int, error) {
+	str := u.Query().Get(name)
+	if str == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.Atoi(str)
+	if err != nil || value <= 0 {
+		return 0, errors.Newf("invalid %s for audit log file: %s", name, str)
+	}
+	return value, nil
+}
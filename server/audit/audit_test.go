@@ -0,0 +1,128 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewSink(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		sink    string
+		wantNil bool
+		wantErr bool
+	}{
+		{sink: "", wantNil: true},
+		{sink: "stdout"},
+		{sink: "file:///tmp/emissary-audit.log?max_size_mb=10&max_backups=2"},
+		{sink: "https://audit.example.com/events"},
+		{sink: "file://", wantErr: true},
+		{sink: "file:///tmp/emissary-audit.log?max_backups=none", wantErr: true},
+		{sink: "ftp://audit.example.com", wantErr: true},
+	}
+
+	for _, test := range tests {
+		sink, err := NewSink(test.sink)
+		if (err != nil) != test.wantErr {
+			t.Errorf("NewSink(%q) returned error %v, want error %v", test.sink, err, test.wantErr)
+			continue
+		}
+		if err == nil && (sink == nil) != test.wantNil {
+			t.Errorf("NewSink(%q) returned sink %v, want nil %v", test.sink, sink, test.wantNil)
+		}
+		if sink != nil {
+			_ = sink.Close()
+		}
+	}
+}
+
+func TestStdoutSink_Close(t *testing.T) {
+	sink, err := NewSink("stdout")
+	if err != nil {
+		t.Fatalf("unable to create sink: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("unable to close sink: %v", err)
+	}
+
+	if _, err := os.Stdout.Stat(); err != nil {
+		t.Fatalf("closing the stdout sink closed stdout: %v", err)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewSink("file://" + path)
+	if err != nil {
+		t.Fatalf("unable to create sink: %v", err)
+	}
+
+	sink.Write(&Event{Target: "db.internal:5432", Decision: DecisionAllowed})
+	sink.Write(&Event{Target: "redis.internal:6379", Decision: DecisionDenied})
+	if err := sink.Close(); err != nil {
+		t.Fatalf("unable to close sink: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unable to open audit log: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("unable to unmarshal audit event %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+
+	if len(events) != 2 || events[0].Target != "db.internal:5432" || events[1].Decision != DecisionDenied {
+		t.Fatalf("unexpected events in audit log: %+v", events)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- event
+	}))
+	defer server.Close()
+
+	sink, err := NewSink(server.URL)
+	if err != nil {
+		t.Fatalf("unable to create sink: %v", err)
+	}
+	sink.Write(&Event{Target: "db.internal:5432", Decision: DecisionAllowed})
+
+	select {
+	case event := <-received:
+		if event.Target != "db.internal:5432" {
+			t.Errorf("unexpected event received: %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("webhook did not receive the audit event")
+	}
+
+	if err := sink.Close(); err != nil {
+		t.Fatalf("unable to close sink: %v", err)
+	}
+}
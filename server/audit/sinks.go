@@ -0,0 +1,137 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// writerSink writes events as JSON lines to a writer
+type writerSink struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+func newWriterSink(w io.Writer) *writerSink {
+	return &writerSink{w: w, enc: json.NewEncoder(w)}
+}
+
+func (s *writerSink) Write(event *Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.enc.Encode(event); err != nil {
+		log.Err(err).Msg("unable to write audit event")
+	}
+}
+
+func (s *writerSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if closer, ok := s.w.(io.Closer); ok {
+		return errors.Wrap(closer.Close(), "unable to close audit log")
+	}
+	return nil
+}
+
+// uncloseable stops a sink closing a writer it doesn't own, such as stdout
+type uncloseable struct {
+	io.Writer
+}
+
+func (uncloseable) Close() error {
+	return nil
+}
+
+// The webhook sink buffers this many events before it starts dropping them
+const webhookBufferSize = 1024
+
+// WebhookTimeout is how long the webhook sink waits for the webhook to accept an event
+const WebhookTimeout = 5 * time.Second
+
+// webhookSink POSTs each event to a webhook in the background, so a slow webhook doesn't hold up tunnels
+type webhookSink struct {
+	url    string
+	client *http.Client
+	events chan *Event
+	done   chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newWebhookSink(url string) *webhookSink {
+	s := &webhookSink{
+		url:    url,
+		client: &http.Client{Timeout: WebhookTimeout},
+		events: make(chan *Event, webhookBufferSize),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *webhookSink) Write(event *Event) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		log.Error().Str("target", event.Target).Msg("audit webhook is closed, dropping audit event")
+		return
+	}
+
+	select {
+	case s.events <- event:
+	default:
+		log.Error().Str("target", event.Target).Msg("audit webhook is not keeping up, dropping audit event")
+	}
+}
+
+// Close sends any buffered events, and then stops the sink
+func (s *webhookSink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+	s.mu.Unlock()
+
+	<-s.done
+	return nil
+}
+
+func (s *webhookSink) run() {
+	defer close(s.done)
+
+	for event := range s.events {
+		if err := s.send(event); err != nil {
+			log.Err(err).Str("target", event.Target).Msg("unable to send audit event to webhook")
+		}
+	}
+}
+
+func (s *webhookSink) send(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal audit event")
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "unable to post audit event")
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Newf("audit webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
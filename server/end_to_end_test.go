@@ -1,24 +1,45 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
+	"github.com/armon/go-socks5"
 	"github.com/frankban/quicktest"
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"go.encore.dev/emissary"
 	"go.encore.dev/emissary/internal/auth"
+	"go.encore.dev/emissary/internal/emissaryproto"
+	"go.encore.dev/emissary/internal/ws"
+	"go.encore.dev/emissary/server/audit"
 	"go.encore.dev/emissary/server/proxy"
 	"go.uber.org/atomic"
+	xproxy "golang.org/x/net/proxy"
 )
 
 func TestMain(m *testing.M) {
@@ -26,6 +47,11 @@ func TestMain(m *testing.M) {
 		zerolog.NewConsoleWriter(),
 	).With().Caller().Timestamp().Logger()
 
+	// A custom transport scheme, which simply connects to the raw TCP port
+	emissary.RegisterTransport("custom", func(server *url.URL) (emissary.Transport, error) {
+		return &customTransport{address: server.Host}, nil
+	})
+
 	os.Exit(m.Run())
 }
 
@@ -56,6 +82,7 @@ func TestProxy_WebsocketTransport(t *testing.T) {
 	go func() {
 		serverShutdown <- RunWithConfig(ctx, config)
 	}()
+	mustWaitForServer(c, ctx, config.HttpPort)
 
 	// Create Client
 	dailer := emissary.NewWebsocketDialer(fmt.Sprintf("ws://localhost:%d", config.HttpPort), config.AuthKeys[0])
@@ -108,6 +135,7 @@ func TestProxy_WebsocketTransport_InvalidKey(t *testing.T) {
 	go func() {
 		serverShutdown <- RunWithConfig(ctx, config)
 	}()
+	mustWaitForServer(c, ctx, config.HttpPort)
 
 	// Create Client
 	key := mustCreateAuthKey(c)
@@ -116,7 +144,7 @@ func TestProxy_WebsocketTransport_InvalidKey(t *testing.T) {
 
 	// Now dial the server via emissary
 	_, err := dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
-	c.Assert(err, quicktest.ErrorMatches, ".* username/password authentication failed", quicktest.Commentf("expected auth error from server"))
+	c.Assert(err, quicktest.ErrorIs, emissary.ErrUnauthorized, quicktest.Commentf("expected auth error from server"))
 
 	// Assert the state of the server
 	c.Assert(targetServer.connections.Load(), quicktest.Equals, int64(0), quicktest.Commentf("target server expected no connection attempts"))
@@ -126,101 +154,1715 @@ func TestProxy_WebsocketTransport_InvalidKey(t *testing.T) {
 	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
 }
 
-func mustFreePort(c *quicktest.C) int {
-	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
-	if err != nil {
-		c.Fatalf("unable to get free port %+v", err)
-	}
+// This test checks the happy path of an end to end test using emissary's proxy over the raw TCP transport
+func TestProxy_TCPTransport(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
 
-	l, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		c.Fatalf("unable to get free port %+v", err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	targetServer := mustCreateTargetServer(c, ctx)
+	defer func() { _ = targetServer.socket.Close() }()
+
+	config := &proxy.Config{
+		HttpPort: 0,
+		TcpPort:  mustFreePort(c),
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: targetServer.port},
+		},
 	}
-	defer func() { _ = l.Close() }()
 
-	return l.Addr().(*net.TCPAddr).Port
-}
+	// Start Server
+	serverShutdown := make(chan error)
+	go func() {
+		serverShutdown <- RunWithConfig(ctx, config)
+	}()
+	mustWaitForServer(c, ctx, config.TcpPort)
 
-func mustCreateAuthKey(c *quicktest.C) auth.Key {
-	key := auth.Key{Data: make([]byte, 32)}
+	// Create Client
+	dailer := emissary.NewTCPDialer(fmt.Sprintf("localhost:%d", config.TcpPort), config.AuthKeys[0])
 
-	id, err := rand.Int(rand.Reader, big.NewInt(1000000))
-	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to generate key id"))
+	// Now dial the server via emissary
+	conn, err := dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while dialing target server"))
+	defer func() { _ = conn.Close() }()
 
-	key.KeyID = uint32(id.Int64())
+	// Now test the transfer of data
+	_, err = conn.Write([]byte("hello world"))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while writing data"))
 
-	_, err = rand.Read(key.Data)
-	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to generate random key"))
+	response, err := io.ReadAll(conn)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while reading response from server"))
+	c.Assert(string(response), quicktest.Equals, "goodbye to hello world", quicktest.Commentf("wrong response received"))
 
-	return key
-}
+	// Assert the state of the server
+	c.Assert(targetServer.connections.Load(), quicktest.Equals, int64(1), quicktest.Commentf("connection wasn't made to target server"))
+	c.Assert(targetServer.lastError.Load(), quicktest.IsNil, quicktest.Commentf("there was an error on the target server"))
 
-type targetServer struct {
-	port        int
-	socket      net.Listener
-	connections *atomic.Int64
-	lastError   *atomic.Error
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
 }
 
-func mustCreateTargetServer(c *quicktest.C, ctx context.Context) *targetServer {
-	targetPort := mustFreePort(c)
-	var lc net.ListenConfig
-	socket, err := lc.Listen(ctx, "tcp", fmt.Sprintf("localhost:%d", targetPort))
-	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create target server"))
+// This test checks that emissary's proxy will reject invalid hmacs over the raw TCP transport
+func TestProxy_TCPTransport_InvalidKey(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
 
-	rtn := &targetServer{
-		port:        targetPort,
-		socket:      socket,
-		connections: atomic.NewInt64(0),
-		lastError:   atomic.NewError(nil),
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	targetServer := mustCreateTargetServer(c, ctx)
+	defer func() { _ = targetServer.socket.Close() }()
+
+	config := &proxy.Config{
+		HttpPort: 0,
+		TcpPort:  mustFreePort(c),
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: targetServer.port},
+		},
 	}
 
+	// Start Server
+	serverShutdown := make(chan error)
 	go func() {
-		log.Debug().Msg("target server listening for connection...")
+		serverShutdown <- RunWithConfig(ctx, config)
+	}()
+	mustWaitForServer(c, ctx, config.TcpPort)
 
-		conn, err := socket.Accept()
-		rtn.connections.Inc()
-		if err != nil {
-			if strings.HasSuffix(err.Error(), "use of closed network connection") {
-				// happens on socket close during shutdown
+	// Create Client
+	key := mustCreateAuthKey(c)
+	key.KeyID = config.AuthKeys[0].KeyID // set the same key ID to force an hmac comparison
+	dailer := emissary.NewTCPDialer(fmt.Sprintf("localhost:%d", config.TcpPort), key)
+
+	// Now dial the server via emissary
+	_, err := dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+	c.Assert(err, quicktest.ErrorIs, emissary.ErrUnauthorized, quicktest.Commentf("expected auth error from server"))
+
+	// Assert the state of the server
+	c.Assert(targetServer.connections.Load(), quicktest.Equals, int64(0), quicktest.Commentf("target server expected no connection attempts"))
+	c.Assert(targetServer.lastError.Load(), quicktest.IsNil, quicktest.Commentf("there was an error on the target server"))
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks that many connections made through one dialer are multiplexed correctly over the transport
+func TestProxy_MultiplexedSession(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	targetServer := mustCreateTargetServer(c, ctx)
+	defer func() { _ = targetServer.socket.Close() }()
+
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  0,
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: targetServer.port},
+		},
+	}
+	serverShutdown := mustStartServer(c, ctx, config)
+
+	// Create Client
+	dailer := emissary.NewWebsocketDialer(fmt.Sprintf("ws://localhost:%d", config.HttpPort), config.AuthKeys[0])
+	defer func() { _ = dailer.Close() }()
+
+	// Now open a number of connections through the dialer at the same time
+	const numConns = 5
+	responses := make(chan string, numConns)
+	errs := make(chan error, numConns)
+	for i := 0; i < numConns; i++ {
+		go func(i int) {
+			conn, err := dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+			if err != nil {
+				errs <- err
 				return
 			}
-			log.Err(err).Msg("target server unable to accept connection")
-			rtn.lastError.Store(err)
-			return
-		}
-		defer func() { _ = conn.Close() }()
+			defer func() { _ = conn.Close() }()
 
-		log.Debug().Msg("target server accepted connection")
+			if _, err := conn.Write([]byte(fmt.Sprintf("hello %d", i))); err != nil {
+				errs <- err
+				return
+			}
 
-		buf := make([]byte, 1024)
-		n, err := conn.Read(buf)
-		if err != nil {
-			log.Err(err).Msg("target server unable to read")
-			rtn.lastError.Store(err)
-			return
-		}
-		log.Debug().Msgf("target server read %s", buf[:n])
+			response, err := io.ReadAll(conn)
+			if err != nil {
+				errs <- err
+				return
+			}
+			responses <- string(response)
+		}(i)
+	}
 
-		response := fmt.Sprintf("goodbye to %s", string(buf[:n]))
-		_, err = conn.Write([]byte(response))
-		if err != nil {
-			log.Err(err).Msg("target server unable to write")
-			rtn.lastError.Store(err)
-			return
+	received := make(map[string]bool)
+	for i := 0; i < numConns; i++ {
+		select {
+		case err := <-errs:
+			c.Fatalf("error while using multiplexed connection: %+v", err)
+		case response := <-responses:
+			received[response] = true
 		}
+	}
+	for i := 0; i < numConns; i++ {
+		c.Assert(received[fmt.Sprintf("goodbye to hello %d", i)], quicktest.IsTrue, quicktest.Commentf("missing response for connection %d", i))
+	}
+
+	// Assert the state of the server
+	c.Assert(targetServer.connections.Load(), quicktest.Equals, int64(numConns), quicktest.Commentf("connections weren't made to target server"))
+	c.Assert(targetServer.lastError.Load(), quicktest.IsNil, quicktest.Commentf("there was an error on the target server"))
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks that concurrent dials share the one session, rather than each connecting their own
+func TestProxy_ConcurrentDialsShareSession(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	targetServer := mustCreateTargetServer(c, ctx)
+	defer func() { _ = targetServer.socket.Close() }()
+
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  mustFreePort(c),
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: targetServer.port},
+		},
+	}
+	serverShutdown := mustStartServer(c, ctx, config)
+
+	// Create Client, over the custom transport so we can count the transport layers it connects
+	address := fmt.Sprintf("localhost:%d", config.TcpPort)
+	dailer, err := emissary.NewDialer("custom://"+address, config.AuthKeys[0])
+	c.Assert(err, quicktest.IsNil)
+	defer func() { _ = dailer.Close() }()
+
+	const numConns = 5
+	errs := make(chan error, numConns)
+	for i := 0; i < numConns; i++ {
+		go func() {
+			conn, err := dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+			if err == nil {
+				_ = conn.Close()
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < numConns; i++ {
+		c.Assert(<-errs, quicktest.IsNil, quicktest.Commentf("error while dialing target server"))
+	}
+
+	dials, _ := customTransportDials.Load(address)
+	c.Assert(dials.(*atomic.Int64).Load(), quicktest.Equals, int64(1), quicktest.Commentf("expected dials to share one session"))
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks that clients which only speak protocol version 1 can still use the server
+func TestProxy_LegacyProtocolClient(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	targetServer := mustCreateTargetServer(c, ctx)
+	defer func() { _ = targetServer.socket.Close() }()
+
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  0,
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: targetServer.port},
+		},
+	}
+	serverShutdown := mustStartServer(c, ctx, config)
+
+	// Connect over a websocket, without asking for a framed connect message, and read the connect message
+	wsc, _, err := websocket.DefaultDialer.DialContext(ctx, fmt.Sprintf("ws://localhost:%d", config.HttpPort), nil)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to connect to server"))
+	transport := ws.NewClient(wsc)
+	defer func() { _ = transport.Close() }()
+
+	_, msg, err := wsc.ReadMessage()
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to read connect message"))
+	connectMessage := &emissaryproto.ServerConnect{}
+	c.Assert(proto.Unmarshal(msg, connectMessage), quicktest.IsNil, quicktest.Commentf("version 1 clients expect an unframed connect message"))
+
+	// Version 1 clients reject any protocol version other than their own
+	c.Assert(connectMessage.ProtocolVersion, quicktest.Equals, int32(emissaryproto.LegacyProtocolVersion), quicktest.Commentf("version 1 clients would reject the server"))
+
+	// Speak SOCKS5 directly over the transport as a version 1 client would
+	date, hmac, err := auth.SignRequest(config.AuthKeys[0], base64.RawStdEncoding.EncodeToString(connectMessage.ConnectionNonce))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to sign request"))
+	socks5, err := xproxy.SOCKS5("tcp", "", &xproxy.Auth{User: date, Password: hmac}, &openConnDialer{transport})
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create socks5 dialer"))
+
+	conn, err := socks5.Dial("tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while dialing target server"))
+
+	_, err = conn.Write([]byte("hello world"))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while writing data"))
+
+	response, err := io.ReadAll(conn)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while reading response from server"))
+	c.Assert(string(response), quicktest.Equals, "goodbye to hello world", quicktest.Commentf("wrong response received"))
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks a websocket client can half close the transport, and still read the response the target sends once
+// it has read everything the client sent
+func TestProxy_WebsocketHalfClose(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
 
-		log.Debug().Msgf("target server wrote back %s", response)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-		err = conn.Close()
+	// A target which only responds once the client has finished writing
+	var lc net.ListenConfig
+	targetSocket, err := lc.Listen(ctx, "tcp", "localhost:0")
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create target server"))
+	defer func() { _ = targetSocket.Close() }()
+	go func() {
+		conn, err := targetSocket.Accept()
 		if err != nil {
-			log.Err(err).Msg("target server couldn't close the connection")
-			rtn.lastError.Store(err)
 			return
 		}
+		defer func() { _ = conn.Close() }()
 
-		log.Debug().Msg("target server closed the connection")
+		request, _ := io.ReadAll(conn)
+		_, _ = fmt.Fprintf(conn, "goodbye to %s", request)
 	}()
+	targetPort := targetSocket.Addr().(*net.TCPAddr).Port
 
-	return rtn
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  0,
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: targetPort},
+		},
+	}
+	serverShutdown := mustStartServer(c, ctx, config)
+
+	// Connect over a websocket which supports half-close, and speak SOCKS5 directly over it
+	dialer := &websocket.Dialer{Subprotocols: []string{ws.HalfCloseSubprotocol}}
+	wsc, _, err := dialer.DialContext(ctx, fmt.Sprintf("ws://localhost:%d", config.HttpPort), nil)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to connect to server"))
+	c.Assert(wsc.Subprotocol(), quicktest.Equals, ws.HalfCloseSubprotocol, quicktest.Commentf("server did not agree to half-close"))
+	transport := ws.NewClient(wsc)
+	defer func() { _ = transport.Close() }()
+
+	connectMessage, err := emissaryproto.ReadConnectMessage(transport)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to read framed connect message"))
+
+	date, hmac, err := auth.SignRequest(config.AuthKeys[0], base64.RawStdEncoding.EncodeToString(connectMessage.ConnectionNonce))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to sign request"))
+	socks5, err := xproxy.SOCKS5("tcp", "", &xproxy.Auth{User: date, Password: hmac}, &openConnDialer{transport})
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create socks5 dialer"))
+
+	conn, err := socks5.Dial("tcp", fmt.Sprintf("localhost:%d", targetPort))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while dialing target server"))
+
+	_, err = conn.Write([]byte("hello world"))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while writing data"))
+	c.Assert(transport.CloseWrite(), quicktest.IsNil, quicktest.Commentf("error while half closing the transport"))
+
+	response, err := io.ReadAll(conn)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while reading response from server"))
+	c.Assert(string(response), quicktest.Equals, "goodbye to hello world", quicktest.Commentf("wrong response received"))
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks data gets through intact when both sides coalesce writes and split them into small frames
+func TestProxy_WebsocketWriteOptions(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	targetServer := mustCreateTargetServer(c, ctx)
+	defer func() { _ = targetServer.socket.Close() }()
+
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  0,
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: targetServer.port},
+		},
+		WSFlushDelay:   time.Millisecond,
+		WSMaxFrameSize: 7,
+	}
+	serverShutdown := mustStartServer(c, ctx, config)
+
+	dailer, err := emissary.NewDialer(
+		fmt.Sprintf("ws://localhost:%d", config.HttpPort), config.AuthKeys[0],
+		emissary.WithWriteCoalescing(time.Millisecond), emissary.WithMaxFrameSize(5),
+	)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create dialer"))
+	defer func() { _ = dailer.Close() }()
+
+	conn, err := dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while dialing target server"))
+	defer func() { _ = conn.Close() }()
+
+	_, err = conn.Write([]byte("hello world"))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while writing data"))
+
+	response, err := io.ReadAll(conn)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while reading response from server"))
+	c.Assert(string(response), quicktest.Equals, "goodbye to hello world", quicktest.Commentf("wrong response received"))
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks websocket compression is only negotiated when the server is configured for it, and that data gets
+// through intact once it is
+func TestProxy_WebsocketCompression(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	targetServer := mustCreateTargetServer(c, ctx)
+	defer func() { _ = targetServer.socket.Close() }()
+
+	newConfig := func(compression bool, compressionLevel int) *proxy.Config {
+		return &proxy.Config{
+			HttpPort: mustFreePort(c),
+			TcpPort:  0,
+			AuthKeys: auth.Keys{
+				mustCreateAuthKey(c),
+			},
+			AllowedProxyTargets: proxy.AllowedProxyTargets{
+				{Host: "localhost", Port: targetServer.port},
+			},
+			WSCompression:      compression,
+			WSCompressionLevel: compressionLevel,
+		}
+	}
+
+	// A level on its own doesn't turn compression on, and flate.NoCompression is as valid a level on the server as it
+	// is on the client
+	uncompressed := newConfig(false, flate.BestSpeed)
+	compressed := newConfig(true, flate.NoCompression)
+	uncompressedShutdown := mustStartServer(c, ctx, uncompressed)
+	compressedShutdown := mustStartServer(c, ctx, compressed)
+
+	negotiated := func(config *proxy.Config) bool {
+		dialer := &websocket.Dialer{EnableCompression: true}
+		wsc, resp, err := dialer.DialContext(ctx, fmt.Sprintf("ws://localhost:%d", config.HttpPort), nil)
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to connect to server"))
+		_ = wsc.Close()
+		return ws.DeflateNegotiated(resp.Header)
+	}
+	c.Assert(negotiated(uncompressed), quicktest.IsFalse, quicktest.Commentf("server agreed to compression it isn't configured for"))
+	c.Assert(negotiated(compressed), quicktest.IsTrue, quicktest.Commentf("server didn't agree to compression"))
+
+	for _, level := range []int{flate.HuffmanOnly - 1, flate.BestCompression + 1} {
+		_, err := emissary.NewDialer(fmt.Sprintf("ws://localhost:%d", compressed.HttpPort), compressed.AuthKeys[0], emissary.WithCompression(level))
+		c.Assert(err, quicktest.IsNotNil, quicktest.Commentf("expected compression level %d to be rejected", level))
+	}
+
+	// Every flate level is valid, even flate.NoCompression which still negotiates permessage-deflate
+	for _, level := range []int{flate.HuffmanOnly, flate.NoCompression, flate.BestCompression} {
+		dailer, err := emissary.NewDialer(
+			fmt.Sprintf("ws://localhost:%d", compressed.HttpPort), compressed.AuthKeys[0],
+			emissary.WithCompression(level),
+		)
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create dialer at compression level %d", level))
+
+		conn, err := dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while dialing target server at compression level %d", level))
+
+		_, err = conn.Write([]byte("hello world"))
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while writing data at compression level %d", level))
+
+		response, err := io.ReadAll(conn)
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while reading response from server at compression level %d", level))
+		c.Assert(string(response), quicktest.Equals, "goodbye to hello world", quicktest.Commentf("wrong response received at compression level %d", level))
+
+		_ = conn.Close()
+		_ = dailer.Close()
+	}
+
+	cancel()
+	c.Assert(<-uncompressedShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+	c.Assert(<-compressedShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks the connect message is framed for every client except websocket clients which haven't asked for it
+func TestProxy_ConnectMessageFraming(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  mustFreePort(c),
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+	}
+	serverShutdown := mustStartServer(c, ctx, config)
+
+	firstMessage := func(subprotocols ...string) []byte {
+		dialer := &websocket.Dialer{Subprotocols: subprotocols}
+		wsc, _, err := dialer.DialContext(ctx, fmt.Sprintf("ws://localhost:%d", config.HttpPort), nil)
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to connect to server"))
+		defer func() { _ = wsc.Close() }()
+
+		_, msg, err := wsc.ReadMessage()
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to read connect message"))
+		return msg
+	}
+
+	connectMessage := &emissaryproto.ServerConnect{}
+	c.Assert(proto.Unmarshal(firstMessage(), connectMessage), quicktest.IsNil, quicktest.Commentf("expected an unframed connect message"))
+	c.Assert(connectMessage.ServerSoftware, quicktest.Equals, emissaryproto.EmissaryServer)
+
+	framed := firstMessage(emissaryproto.FramedConnectSubprotocol)
+	c.Assert(framed[0], quicktest.Equals, byte(emissaryproto.FramedConnectMarker), quicktest.Commentf("expected a framed connect message"))
+	connectMessage, err := emissaryproto.ReadConnectMessage(bytes.NewReader(framed))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to read framed connect message"))
+	c.Assert(connectMessage.ServerSoftware, quicktest.Equals, emissaryproto.EmissaryServer)
+
+	// Over TCP, the message is always framed and read a byte at a time, so a short read doesn't break it
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", config.TcpPort))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to connect to server"))
+	defer func() { _ = conn.Close() }()
+
+	connectMessage, err = emissaryproto.ReadConnectMessage(iotest.OneByteReader(conn))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to read framed connect message"))
+	c.Assert(connectMessage.ServerSoftware, quicktest.Equals, emissaryproto.EmissaryServer)
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks the client negotiates a protocol version with servers which support other versions
+func TestProxy_VersionNegotiation(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	targetServer := mustCreateTargetServer(c, ctx)
+	defer func() { _ = targetServer.socket.Close() }()
+
+	// A server from before version negotiation, which only speaks version 1
+	oldServer := mustCreateFakeServer(c, ctx, &emissaryproto.ServerConnect{ProtocolVersion: 1})
+	defer func() { _ = oldServer.Close() }()
+
+	dailer := emissary.NewTCPDialer(oldServer.Addr().String(), mustCreateAuthKey(c))
+	defer func() { _ = dailer.Close() }()
+
+	conn, err := dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while dialing target server via old server"))
+
+	_, err = conn.Write([]byte("hello world"))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while writing data"))
+
+	response, err := io.ReadAll(conn)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while reading response from server"))
+	c.Assert(string(response), quicktest.Equals, "goodbye to hello world", quicktest.Commentf("wrong response received"))
+
+	// A server from the future, which no longer supports any version we do
+	futureServer := mustCreateFakeServer(c, ctx, &emissaryproto.ServerConnect{
+		ProtocolVersion:    1,
+		MinProtocolVersion: emissaryproto.ProtocolVersion + 1,
+		MaxProtocolVersion: emissaryproto.ProtocolVersion + 2,
+	})
+	defer func() { _ = futureServer.Close() }()
+
+	dailer = emissary.NewTCPDialer(futureServer.Addr().String(), mustCreateAuthKey(c))
+	defer func() { _ = dailer.Close() }()
+
+	_, err = dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+	c.Assert(err, quicktest.ErrorIs, emissary.ErrProtocolVersion, quicktest.Commentf("expected no common protocol version"))
+
+	c.Assert(targetServer.connections.Load(), quicktest.Equals, int64(1), quicktest.Commentf("expected one connection to the target server"))
+}
+
+// This test checks that dialers can be created from URLs for each of the transports
+func TestProxy_NewDialer(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	targetServer := mustCreateTargetServer(c, ctx)
+	defer func() { _ = targetServer.socket.Close() }()
+
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  mustFreePort(c),
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: targetServer.port},
+		},
+	}
+	serverShutdown := mustStartServer(c, ctx, config)
+
+	urls := []string{
+		fmt.Sprintf("ws://localhost:%d", config.HttpPort),
+		fmt.Sprintf("tcp://localhost:%d", config.TcpPort),
+		fmt.Sprintf("custom://localhost:%d", config.TcpPort),
+	}
+	for _, serverURL := range urls {
+		dailer, err := emissary.NewDialer(serverURL, config.AuthKeys[0])
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create dialer for %s", serverURL))
+
+		conn, err := dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while dialing target server via %s", serverURL))
+
+		_, err = conn.Write([]byte("hello world"))
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while writing data via %s", serverURL))
+
+		response, err := io.ReadAll(conn)
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while reading response from server via %s", serverURL))
+		c.Assert(string(response), quicktest.Equals, "goodbye to hello world", quicktest.Commentf("wrong response received via %s", serverURL))
+
+		_ = conn.Close()
+		_ = dailer.Close()
+	}
+
+	// Check invalid URLs are rejected
+	_, err := emissary.NewDialer("unknown://localhost:1234", config.AuthKeys[0])
+	c.Assert(err, quicktest.ErrorMatches, "unknown emissary transport scheme: .*")
+	_, err = emissary.NewDialer("tcp://localhost", config.AuthKeys[0])
+	c.Assert(err, quicktest.ErrorMatches, "emissary tcp url must include a host and port: .*")
+
+	// Assert the state of the server
+	c.Assert(targetServer.connections.Load(), quicktest.Equals, int64(len(urls)), quicktest.Commentf("connections weren't made to target server"))
+	c.Assert(targetServer.lastError.Load(), quicktest.IsNil, quicktest.Commentf("there was an error on the target server"))
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks that the server can terminate TLS itself on both the http and tcp ports
+func TestProxy_TLS(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	targetServer := mustCreateTargetServer(c, ctx)
+	defer func() { _ = targetServer.socket.Close() }()
+
+	cert, rootCAs := mustCreateCertificate(c)
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  mustFreePort(c),
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: targetServer.port},
+		},
+		TLSCertificate: &cert,
+	}
+	serverShutdown := mustStartServer(c, ctx, config)
+
+	urls := []string{
+		fmt.Sprintf("wss://localhost:%d", config.HttpPort),
+		fmt.Sprintf("tls://localhost:%d", config.TcpPort),
+	}
+	for _, serverURL := range urls {
+		dailer, err := emissary.NewDialer(serverURL, config.AuthKeys[0], emissary.WithTLSConfig(&tls.Config{RootCAs: rootCAs, MinVersion: tls.VersionTLS12}))
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create dialer for %s", serverURL))
+
+		conn, err := dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while dialing target server via %s", serverURL))
+
+		_, err = conn.Write([]byte("hello world"))
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while writing data via %s", serverURL))
+
+		response, err := io.ReadAll(conn)
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while reading response from server via %s", serverURL))
+		c.Assert(string(response), quicktest.Equals, "goodbye to hello world", quicktest.Commentf("wrong response received via %s", serverURL))
+
+		_ = conn.Close()
+		_ = dailer.Close()
+	}
+
+	// Clients which don't trust the certificate should be rejected
+	dailer, err := emissary.NewDialer(fmt.Sprintf("tls://localhost:%d", config.TcpPort), config.AuthKeys[0])
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create dialer"))
+	_, err = dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+	c.Assert(err, quicktest.ErrorMatches, ".*certificate signed by unknown authority", quicktest.Commentf("expected tls error"))
+
+	// Assert the state of the server
+	c.Assert(targetServer.connections.Load(), quicktest.Equals, int64(len(urls)), quicktest.Commentf("connections weren't made to target server"))
+	c.Assert(targetServer.lastError.Load(), quicktest.IsNil, quicktest.Commentf("there was an error on the target server"))
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks that clients can authenticate using a client certificate instead of a hmac
+func TestProxy_ClientCertificate(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	targetServer := mustCreateTargetServer(c, ctx)
+	defer func() { _ = targetServer.socket.Close() }()
+
+	cert, rootCAs := mustCreateCertificate(c)
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  mustFreePort(c),
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: targetServer.port},
+		},
+		TLSCertificate:    &cert,
+		TLSClientCAs:      rootCAs,
+		TLSAllowedClients: []string{"platform"},
+	}
+	serverShutdown := mustStartServer(c, ctx, config)
+
+	clientTLS := func(commonName string) emissary.Option {
+		return emissary.WithTLSConfig(&tls.Config{
+			RootCAs:      rootCAs,
+			Certificates: []tls.Certificate{mustCreateClientCertificate(c, cert, commonName)},
+			MinVersion:   tls.VersionTLS12,
+		})
+	}
+
+	urls := []string{
+		fmt.Sprintf("wss://localhost:%d", config.HttpPort),
+		fmt.Sprintf("tls://localhost:%d", config.TcpPort),
+	}
+	for _, serverURL := range urls {
+		// An allowed client certificate doesn't need a key
+		dailer, err := emissary.NewDialer(serverURL, auth.Key{}, clientTLS("platform"))
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create dialer for %s", serverURL))
+
+		conn, err := dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while dialing target server via %s", serverURL))
+
+		_, err = conn.Write([]byte("hello world"))
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while writing data via %s", serverURL))
+
+		response, err := io.ReadAll(conn)
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while reading response from server via %s", serverURL))
+		c.Assert(string(response), quicktest.Equals, "goodbye to hello world", quicktest.Commentf("wrong response received via %s", serverURL))
+
+		_ = conn.Close()
+		_ = dailer.Close()
+
+		// But a client certificate which isn't in the allowed list must be rejected
+		dailer, err = emissary.NewDialer(serverURL, auth.Key{}, clientTLS("intruder"))
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create dialer for %s", serverURL))
+
+		_, err = dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+		c.Assert(err, quicktest.ErrorIs, emissary.ErrUnauthorized, quicktest.Commentf("expected auth error from server via %s", serverURL))
+	}
+
+	// Assert the state of the server
+	c.Assert(targetServer.connections.Load(), quicktest.Equals, int64(len(urls)), quicktest.Commentf("connections weren't made to target server"))
+	c.Assert(targetServer.lastError.Load(), quicktest.IsNil, quicktest.Commentf("there was an error on the target server"))
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks that keys with their own scope can only reach the targets in that scope
+func TestProxy_KeyScopes(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	postgres := mustCreateTargetServer(c, ctx)
+	defer func() { _ = postgres.socket.Close() }()
+	redis := mustCreateTargetServer(c, ctx)
+	defer func() { _ = redis.socket.Close() }()
+
+	migrationKey := mustCreateAuthKey(c)
+	cliKey := mustCreateAuthKey(c)
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  0,
+		AuthKeys: auth.Keys{migrationKey, cliKey},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: postgres.port},
+			{Host: "localhost", Port: redis.port},
+		},
+		KeyScopes: proxy.KeyScopes{
+			migrationKey.KeyID: {{Host: "localhost", Port: postgres.port}},
+		},
+	}
+	serverShutdown := mustStartServer(c, ctx, config)
+
+	dial := func(key auth.Key, target *targetServer) error {
+		dailer := emissary.NewWebsocketDialer(fmt.Sprintf("ws://localhost:%d", config.HttpPort), key)
+		defer func() { _ = dailer.Close() }()
+
+		conn, err := dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", target.port))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	c.Assert(dial(migrationKey, postgres), quicktest.IsNil, quicktest.Commentf("migration key should reach postgres"))
+	c.Assert(dial(migrationKey, redis), quicktest.ErrorIs, emissary.ErrTargetNotAllowed, quicktest.Commentf("migration key should not reach redis"))
+	c.Assert(dial(cliKey, postgres), quicktest.IsNil, quicktest.Commentf("cli key should reach postgres"))
+	c.Assert(dial(cliKey, redis), quicktest.IsNil, quicktest.Commentf("cli key should reach redis"))
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks that clients authenticated by certificate with their own scope can only reach the targets in it
+func TestProxy_ClientScopes(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	postgres := mustCreateTargetServer(c, ctx)
+	defer func() { _ = postgres.socket.Close() }()
+	redis := mustCreateTargetServer(c, ctx)
+	defer func() { _ = redis.socket.Close() }()
+
+	cert, rootCAs := mustCreateCertificate(c)
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  0,
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: postgres.port},
+			{Host: "localhost", Port: redis.port},
+		},
+		ClientScopes: proxy.ClientScopes{
+			"migrations": {{Host: "localhost", Port: postgres.port}},
+		},
+		TLSCertificate: &cert,
+		TLSClientCAs:   rootCAs,
+	}
+	serverShutdown := mustStartServer(c, ctx, config)
+
+	dial := func(commonName string, target *targetServer) error {
+		dailer, err := emissary.NewDialer(fmt.Sprintf("wss://localhost:%d", config.HttpPort), auth.Key{}, emissary.WithTLSConfig(&tls.Config{
+			RootCAs:      rootCAs,
+			Certificates: []tls.Certificate{mustCreateClientCertificate(c, cert, commonName)},
+			MinVersion:   tls.VersionTLS12,
+		}))
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create dialer"))
+		defer func() { _ = dailer.Close() }()
+
+		conn, err := dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", target.port))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	c.Assert(dial("migrations", postgres), quicktest.IsNil, quicktest.Commentf("migrations client should reach postgres"))
+	c.Assert(dial("migrations", redis), quicktest.ErrorIs, emissary.ErrTargetNotAllowed, quicktest.Commentf("migrations client should not reach redis"))
+	c.Assert(dial("platform", postgres), quicktest.IsNil, quicktest.Commentf("platform client should reach postgres"))
+	c.Assert(dial("platform", redis), quicktest.IsNil, quicktest.Commentf("platform client should reach redis"))
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks clients are told why the server rejected their handshake
+func TestProxy_HandshakeErrors(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	targetServer := mustCreateTargetServer(c, ctx)
+	defer func() { _ = targetServer.socket.Close() }()
+	closedPort := mustFreePort(c)
+
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  mustFreePort(c),
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: targetServer.port},
+			{Host: "localhost", Port: closedPort},
+		},
+	}
+	serverShutdown := mustStartServer(c, ctx, config)
+
+	dial := func(key auth.Key, port int) error {
+		dailer := emissary.NewWebsocketDialer(fmt.Sprintf("ws://localhost:%d", config.HttpPort), key)
+		defer func() { _ = dailer.Close() }()
+
+		conn, err := dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", port))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	c.Assert(dial(mustCreateAuthKey(c), targetServer.port), quicktest.ErrorIs, emissary.ErrUnknownKeyID, quicktest.Commentf("expected an unknown key to be rejected"))
+	c.Assert(dial(config.AuthKeys[0], closedPort), quicktest.ErrorIs, emissary.ErrTargetUnreachable, quicktest.Commentf("expected the closed port to be unreachable"))
+	c.Assert(dial(config.AuthKeys[0], targetServer.port+1), quicktest.ErrorIs, emissary.ErrTargetNotAllowed, quicktest.Commentf("expected an unlisted target to be rejected"))
+
+	// A version 1 client speaking SOCKS5 directly is told why after the SOCKS5 reply
+	var d net.Dialer
+	transport, err := d.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", config.TcpPort))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to connect to server"))
+	defer func() { _ = transport.Close() }()
+
+	_, err = emissaryproto.ReadConnectMessage(transport)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to read connect message"))
+
+	socks5, err := xproxy.SOCKS5("tcp", "", &xproxy.Auth{User: "not a date", Password: "not a hmac"}, &openConnDialer{transport})
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create socks5 dialer"))
+	withConn, ok := socks5.(interface {
+		DialWithConn(ctx context.Context, c net.Conn, network, address string) (net.Addr, error)
+	})
+	c.Assert(ok, quicktest.IsTrue, quicktest.Commentf("socks5 dialer can't dial over an open connection"))
+	_, err = withConn.DialWithConn(ctx, transport, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+	c.Assert(err, quicktest.ErrorMatches, ".* username/password authentication failed", quicktest.Commentf("expected auth error from server"))
+
+	handshakeErr, err := emissaryproto.ReadHandshakeError(transport)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to read handshake error"))
+	c.Assert(handshakeErr.Reason, quicktest.Equals, emissaryproto.HandshakeError_UNAUTHORIZED)
+
+	// Assert the state of the server
+	c.Assert(targetServer.connections.Load(), quicktest.Equals, int64(0), quicktest.Commentf("target server expected no connection attempts"))
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks datagrams can be tunnelled to allowed UDP targets
+func TestProxy_UDP(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Start a UDP server which replies to each datagram
+	udpServer, err := net.ListenPacket("udp", "localhost:0")
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create udp server"))
+	defer func() { _ = udpServer.Close() }()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := udpServer.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = udpServer.WriteTo([]byte("goodbye to "+string(buf[:n])), addr)
+		}
+	}()
+	udpPort := udpServer.LocalAddr().(*net.UDPAddr).Port
+
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  0,
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: udpPort, Network: "udp"},
+		},
+	}
+	serverShutdown := mustStartServer(c, ctx, config)
+
+	dailer := emissary.NewWebsocketDialer(fmt.Sprintf("ws://localhost:%d", config.HttpPort), config.AuthKeys[0])
+	defer func() { _ = dailer.Close() }()
+
+	conn, err := dailer.DialContext(ctx, "udp", fmt.Sprintf("localhost:%d", udpPort))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while dialing udp server"))
+	defer func() { _ = conn.Close() }()
+
+	// Each write and read should be a single datagram
+	for _, msg := range []string{"hello world", "hello again"} {
+		_, err = conn.Write([]byte(msg))
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while writing datagram"))
+
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while reading datagram"))
+		c.Assert(string(buf[:n]), quicktest.Equals, "goodbye to "+msg, quicktest.Commentf("wrong datagram received"))
+	}
+
+	// The connection can also be used as a packet conn
+	packetConn, ok := conn.(net.PacketConn)
+	c.Assert(ok, quicktest.IsTrue, quicktest.Commentf("udp connection should be a packet conn"))
+	_, err = packetConn.WriteTo([]byte("hello packet"), conn.RemoteAddr())
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while writing datagram"))
+	buf := make([]byte, 1024)
+	n, _, err := packetConn.ReadFrom(buf)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while reading datagram"))
+	c.Assert(string(buf[:n]), quicktest.Equals, "goodbye to hello packet", quicktest.Commentf("wrong datagram received"))
+
+	// UDP rules only allow UDP, and UDP targets must be allowed
+	_, err = dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", udpPort))
+	c.Assert(err, quicktest.ErrorIs, emissary.ErrTargetNotAllowed, quicktest.Commentf("expected udp rule to not allow tcp"))
+	_, err = dailer.DialContext(ctx, "udp", fmt.Sprintf("localhost:%d", udpPort+1))
+	c.Assert(err, quicktest.ErrorIs, emissary.ErrTargetNotAllowed, quicktest.Commentf("expected unlisted udp target to be rejected"))
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks that a client can ask the server to listen on an allowed address, and accept the connections
+// made to it through the server
+func TestProxy_Listen(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	listenPort := mustFreePort(c)
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  0,
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "127.0.0.1", Port: listenPort, Listen: true},
+		},
+	}
+	serverShutdown := mustStartServer(c, ctx, config)
+
+	dailer := emissary.NewWebsocketDialer(fmt.Sprintf("ws://localhost:%d", config.HttpPort), config.AuthKeys[0])
+	defer func() { _ = dailer.Close() }()
+
+	listener, err := dailer.Listen(ctx, fmt.Sprintf("127.0.0.1:%d", listenPort))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while listening through emissary"))
+	c.Assert(listener.Addr().String(), quicktest.Equals, fmt.Sprintf("127.0.0.1:%d", listenPort), quicktest.Commentf("wrong listen address"))
+
+	// Reply to each connection accepted through the server
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				msg, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				_, _ = fmt.Fprintf(conn, "goodbye from %s to %s", conn.LocalAddr(), msg)
+			}()
+		}
+	}()
+
+	// Connections made to the address the server is listening on should reach the listener
+	for _, msg := range []string{"first", "second"} {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", listenPort))
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while connecting to the server's listener"))
+		_, err = fmt.Fprintf(conn, "%s\n", msg)
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while writing to the server's listener"))
+
+		reply, err := io.ReadAll(conn)
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while reading from the server's listener"))
+		c.Assert(string(reply), quicktest.Equals, fmt.Sprintf("goodbye from 127.0.0.1:%d to %s\n", listenPort, msg))
+		_ = conn.Close()
+	}
+
+	// Only allowed addresses can be listened on
+	_, err = dailer.Listen(ctx, fmt.Sprintf("127.0.0.1:%d", listenPort+1))
+	c.Assert(err, quicktest.ErrorIs, emissary.ErrTargetNotAllowed, quicktest.Commentf("expected unlisted listen address to be rejected"))
+	_, err = dailer.DialContext(ctx, "tcp", fmt.Sprintf("127.0.0.1:%d", listenPort))
+	c.Assert(err, quicktest.ErrorIs, emissary.ErrTargetNotAllowed, quicktest.Commentf("expected listen rule to not allow connecting"))
+
+	// Closing the listener should stop the server listening, so the address can be listened on again
+	c.Assert(listener.Close(), quicktest.IsNil, quicktest.Commentf("error while closing listener"))
+	_, err = listener.Accept()
+	c.Assert(err, quicktest.ErrorIs, net.ErrClosed, quicktest.Commentf("expected accept to fail once closed"))
+	var relistener net.Listener
+	for {
+		relistener, err = dailer.Listen(ctx, fmt.Sprintf("127.0.0.1:%d", listenPort))
+		if !errors.Is(err, emissary.ErrListenFailed) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while listening through emissary again"))
+	_ = relistener.Close()
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks a deny rule without any ports or network denies a whole CIDR block, even where allow rules cover it
+func TestProxy_DenyRules(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	targetServer := mustCreateTargetServer(c, ctx)
+	defer func() { _ = targetServer.socket.Close() }()
+
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  0,
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "127.0.0.0/8", Ports: "*"},
+			{Host: "127.0.0.0/8", Ports: "*", Network: "udp"},
+			{Host: "127.0.0.0/8", Ports: "*", Listen: true},
+			{Host: "127.0.0.2/31", Deny: true},
+		},
+	}
+	c.Assert(config.AllowedProxyTargets.Validate(), quicktest.IsNil, quicktest.Commentf("expected a deny rule without ports to be valid"))
+	serverShutdown := mustStartServer(c, ctx, config)
+
+	dailer := emissary.NewWebsocketDialer(fmt.Sprintf("ws://localhost:%d", config.HttpPort), config.AuthKeys[0])
+	defer func() { _ = dailer.Close() }()
+
+	// Addresses outside the denied block are still allowed
+	conn, err := dailer.DialContext(ctx, "tcp", fmt.Sprintf("127.0.0.1:%d", targetServer.port))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while dialing allowed target"))
+	_ = conn.Close()
+
+	// Every port of every address within it is denied
+	for _, addr := range []string{
+		fmt.Sprintf("127.0.0.2:%d", targetServer.port),
+		"127.0.0.3:22",
+		"127.0.0.3:65535",
+	} {
+		_, err = dailer.DialContext(ctx, "tcp", addr)
+		c.Assert(err, quicktest.ErrorIs, emissary.ErrTargetNotAllowed, quicktest.Commentf("expected %s to be denied", addr))
+	}
+
+	// Including over udp
+	udpConn, err := dailer.DialContext(ctx, "udp", "127.0.0.1:53")
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while dialing allowed udp target"))
+	_ = udpConn.Close()
+	_, err = dailer.DialContext(ctx, "udp", "127.0.0.2:53")
+	c.Assert(err, quicktest.ErrorIs, emissary.ErrTargetNotAllowed, quicktest.Commentf("expected udp to be denied"))
+
+	// And listening
+	listener, err := dailer.Listen(ctx, fmt.Sprintf("127.0.0.1:%d", mustFreePort(c)))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while listening on allowed address"))
+	_ = listener.Close()
+	_, err = dailer.Listen(ctx, fmt.Sprintf("127.0.0.2:%d", mustFreePort(c)))
+	c.Assert(err, quicktest.ErrorIs, emissary.ErrTargetNotAllowed, quicktest.Commentf("expected listening to be denied"))
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks that an allowed hostname which resolves into a forbidden network is rejected
+func TestProxy_ForbiddenNetworks(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	targetServer := mustCreateTargetServer(c, ctx)
+	defer func() { _ = targetServer.socket.Close() }()
+
+	_, loopbackV4, _ := net.ParseCIDR("127.0.0.0/8")
+	_, loopbackV6, _ := net.ParseCIDR("::1/128")
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  0,
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: targetServer.port},
+		},
+		ForbiddenNetworks: []*net.IPNet{loopbackV4, loopbackV6},
+	}
+	serverShutdown := mustStartServer(c, ctx, config)
+
+	// Create Client
+	dailer := emissary.NewWebsocketDialer(fmt.Sprintf("ws://localhost:%d", config.HttpPort), config.AuthKeys[0])
+	defer func() { _ = dailer.Close() }()
+
+	// Now dial the server via emissary
+	_, err := dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+	c.Assert(err, quicktest.ErrorIs, emissary.ErrTargetNotAllowed, quicktest.Commentf("expected the forbidden network to be rejected"))
+
+	// Assert the state of the server
+	c.Assert(targetServer.connections.Load(), quicktest.Equals, int64(0), quicktest.Commentf("target server expected no connection attempts"))
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks the metrics endpoint reports on the connections made through the proxy
+func TestProxy_Metrics(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	targetServer := mustCreateTargetServer(c, ctx)
+	defer func() { _ = targetServer.socket.Close() }()
+
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  0,
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: targetServer.port},
+		},
+		MetricsPath: "/metrics",
+	}
+	serverShutdown := mustStartServer(c, ctx, config)
+
+	// Proxy some data through the server
+	dailer := emissary.NewWebsocketDialer(fmt.Sprintf("ws://localhost:%d", config.HttpPort), config.AuthKeys[0])
+	defer func() { _ = dailer.Close() }()
+
+	target := fmt.Sprintf("localhost:%d", targetServer.port)
+	conn, err := dailer.DialContext(ctx, "tcp", target)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while dialing target server"))
+	_, err = conn.Write([]byte("hello world"))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while writing data"))
+	_, err = io.ReadAll(conn)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while reading response from server"))
+	_ = conn.Close()
+
+	// Now scrape the metrics
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/metrics", config.HttpPort))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while fetching metrics"))
+	defer func() { _ = resp.Body.Close() }()
+	c.Assert(resp.StatusCode, quicktest.Equals, http.StatusOK)
+	body, err := io.ReadAll(resp.Body)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while reading metrics"))
+
+	metrics := string(body)
+	c.Assert(metrics, quicktest.Contains, `emissary_active_sessions{transport="http"}`)
+	c.Assert(metrics, quicktest.Contains, `emissary_handshakes_total{outcome="success"}`)
+	rule := fmt.Sprintf("tcp localhost:%d", targetServer.port)
+	c.Assert(metrics, quicktest.Contains, fmt.Sprintf(`emissary_target_bytes_total{direction="out",rule=%q} 11`, rule))
+	c.Assert(metrics, quicktest.Contains, fmt.Sprintf(`emissary_target_bytes_total{direction="in",rule=%q} 22`, rule))
+	c.Assert(metrics, quicktest.Contains, fmt.Sprintf(`emissary_target_dial_duration_seconds_count{result="success",rule=%q} 1`, rule))
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks an audit event is written for each tunnel once it closes
+func TestProxy_AuditLog(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	targetServer := mustCreateTargetServer(c, ctx)
+	defer func() { _ = targetServer.socket.Close() }()
+
+	sink := &recordingSink{events: make(chan *audit.Event, 10)}
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  0,
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: targetServer.port},
+		},
+		AuditSink: sink,
+	}
+	serverShutdown := mustStartServer(c, ctx, config)
+
+	dailer := emissary.NewWebsocketDialer(fmt.Sprintf("ws://localhost:%d", config.HttpPort), config.AuthKeys[0])
+	defer func() { _ = dailer.Close() }()
+
+	// An allowed tunnel
+	target := fmt.Sprintf("localhost:%d", targetServer.port)
+	conn, err := dailer.DialContext(ctx, "tcp", target)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while dialing target server"))
+	_, err = conn.Write([]byte("hello world"))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while writing data"))
+	_, err = io.ReadAll(conn)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while reading response from server"))
+	_ = conn.Close()
+
+	event := sink.mustReceive(c, ctx)
+	c.Assert(event.KeyID, quicktest.IsNotNil)
+	c.Assert(*event.KeyID, quicktest.Equals, config.AuthKeys[0].KeyID)
+	c.Assert(event.Transport, quicktest.Equals, proxy.TransportHTTP)
+	c.Assert(event.Target, quicktest.Equals, target)
+	c.Assert(event.ResolvedIP, quicktest.Not(quicktest.Equals), "")
+	c.Assert(event.Decision, quicktest.Equals, audit.DecisionAllowed)
+	c.Assert(event.BytesOut, quicktest.Equals, int64(11))
+	c.Assert(event.BytesIn, quicktest.Equals, int64(22))
+	c.Assert(event.End.Before(event.Start), quicktest.IsFalse)
+
+	// A denied tunnel
+	_, err = dailer.DialContext(ctx, "tcp", "localhost:1")
+	c.Assert(err, quicktest.ErrorIs, emissary.ErrTargetNotAllowed)
+
+	event = sink.mustReceive(c, ctx)
+	c.Assert(event.Target, quicktest.Equals, "localhost:1")
+	c.Assert(event.Decision, quicktest.Equals, audit.DecisionDenied)
+	c.Assert(event.CloseReason, quicktest.Not(quicktest.Equals), "closed")
+
+	cancel()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks that on shutdown, open tunnels are allowed to finish while new ones are rejected
+func TestProxy_GracefulShutdown(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	serverCtx, shutdown := context.WithCancel(ctx)
+	defer shutdown()
+
+	targetServer := mustCreateTargetServer(c, ctx)
+	defer func() { _ = targetServer.socket.Close() }()
+
+	config := &proxy.Config{
+		HttpPort: mustFreePort(c),
+		TcpPort:  mustFreePort(c),
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: targetServer.port},
+		},
+		HealthPath:   "/healthz",
+		DrainTimeout: 5 * time.Second,
+	}
+	serverShutdown := mustStartServer(c, serverCtx, config)
+
+	// Open a tunnel, and then ask the server to shut down
+	dailer := emissary.NewWebsocketDialer(fmt.Sprintf("ws://localhost:%d", config.HttpPort), config.AuthKeys[0])
+	defer func() { _ = dailer.Close() }()
+	conn, err := dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while dialing target server"))
+	defer func() { _ = conn.Close() }()
+
+	shutdown()
+
+	// The server should report itself as unhealthy while draining
+	for {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d/healthz", config.HttpPort))
+		c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while checking health"))
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// New tunnels should be rejected
+	_, err = emissary.NewWebsocketDialer(fmt.Sprintf("ws://localhost:%d", config.HttpPort), config.AuthKeys[0]).
+		DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+	c.Assert(err, quicktest.IsNotNil, quicktest.Commentf("expected new websocket tunnels to be rejected"))
+	_, err = emissary.NewTCPDialer(fmt.Sprintf("localhost:%d", config.TcpPort), config.AuthKeys[0]).
+		DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+	c.Assert(err, quicktest.IsNotNil, quicktest.Commentf("expected new tcp tunnels to be rejected"))
+
+	// But the open tunnel should still work
+	_, err = conn.Write([]byte("hello world"))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while writing data"))
+	response, err := io.ReadAll(conn)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while reading response from server"))
+	c.Assert(string(response), quicktest.Equals, "goodbye to hello world", quicktest.Commentf("wrong response received"))
+	_ = conn.Close()
+
+	// Once it's closed, the server should shutdown without waiting for the drain timeout
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+}
+
+// This test checks that tunnels still open after the drain timeout are closed
+func TestProxy_GracefulShutdown_Timeout(t *testing.T) {
+	c := quicktest.New(t)
+	c.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	serverCtx, shutdown := context.WithCancel(ctx)
+	defer shutdown()
+
+	targetServer := mustCreateTargetServer(c, ctx)
+	defer func() { _ = targetServer.socket.Close() }()
+
+	config := &proxy.Config{
+		HttpPort: 0,
+		TcpPort:  mustFreePort(c),
+		AuthKeys: auth.Keys{
+			mustCreateAuthKey(c),
+		},
+		AllowedProxyTargets: proxy.AllowedProxyTargets{
+			{Host: "localhost", Port: targetServer.port},
+		},
+		DrainTimeout: 100 * time.Millisecond,
+	}
+	serverShutdown := mustStartServer(c, serverCtx, config)
+
+	dailer := emissary.NewTCPDialer(fmt.Sprintf("localhost:%d", config.TcpPort), config.AuthKeys[0])
+	defer func() { _ = dailer.Close() }()
+	conn, err := dailer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", targetServer.port))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("error while dialing target server"))
+	defer func() { _ = conn.Close() }()
+
+	// Shutdown while the tunnel is still open
+	shutdown()
+	c.Assert(<-serverShutdown, quicktest.IsNil, quicktest.Commentf("run with config returned error"))
+
+	// The tunnel should have been closed by the server
+	_, err = io.ReadAll(conn)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("expected the tunnel to be closed"))
+}
+
+func mustFreePort(c *quicktest.C) int {
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		c.Fatalf("unable to get free port %+v", err)
+	}
+
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		c.Fatalf("unable to get free port %+v", err)
+	}
+	defer func() { _ = l.Close() }()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// mustStartServer runs the server in the background, returning once it is accepting connections
+func mustStartServer(c *quicktest.C, ctx context.Context, config *proxy.Config) <-chan error {
+	serverShutdown := make(chan error)
+	go func() {
+		serverShutdown <- RunWithConfig(ctx, config)
+	}()
+
+	if config.HttpPort > 0 {
+		mustWaitForServer(c, ctx, config.HttpPort)
+	}
+	if config.TcpPort > 0 {
+		mustWaitForServer(c, ctx, config.TcpPort)
+	}
+
+	return serverShutdown
+}
+
+// mustWaitForServer blocks until the server is accepting connections on the given port
+func mustWaitForServer(c *quicktest.C, ctx context.Context, port int) {
+	var d net.Dialer
+	for {
+		conn, err := d.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", port))
+		if err == nil {
+			_ = conn.Close()
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			c.Fatalf("server never started listening on port %d: %+v", port, err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func mustCreateAuthKey(c *quicktest.C) auth.Key {
+	key := auth.Key{Data: make([]byte, 32)}
+
+	id, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to generate key id"))
+
+	key.KeyID = uint32(id.Int64())
+
+	_, err = rand.Read(key.Data)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to generate random key"))
+
+	return key
+}
+
+// mustCreateCertificate creates a self-signed certificate for localhost and a pool which trusts it
+func mustCreateCertificate(c *quicktest.C) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to generate private key"))
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create certificate"))
+
+	leaf, err := x509.ParseCertificate(der)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to parse certificate"))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// mustCreateClientCertificate creates a client certificate signed by the given CA
+func mustCreateClientCertificate(c *quicktest.C, ca tls.Certificate, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to generate private key"))
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, &key.PublicKey, ca.PrivateKey)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create client certificate"))
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+type targetServer struct {
+	port        int
+	socket      net.Listener
+	connections *atomic.Int64
+	lastError   *atomic.Error
+}
+
+// mustCreateFakeServer starts a server which sends the given connect message, and then proxies any target for any
+// credentials over SOCKS5, to stand in for servers running other versions of emissary
+func mustCreateFakeServer(c *quicktest.C, ctx context.Context, connectMessage *emissaryproto.ServerConnect) net.Listener {
+	var lc net.ListenConfig
+	socket, err := lc.Listen(ctx, "tcp", "localhost:0")
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create fake server"))
+
+	connectMessage.ServerSoftware = emissaryproto.EmissaryServer
+	connectMessage.ConnectionNonce = make([]byte, emissaryproto.NonceSize)
+	_, err = rand.Read(connectMessage.ConnectionNonce)
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create nonce"))
+	server, err := socks5.New(&socks5.Config{Credentials: anyCredentials{}})
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create socks5 server"))
+
+	go func() {
+		for {
+			conn, err := socket.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				// Servers from before framing was introduced only send unframed connect messages
+				if err := emissaryproto.WriteConnectMessage(conn, connectMessage, false); err != nil {
+					_ = conn.Close()
+					return
+				}
+				_ = server.ServeConn(conn)
+			}()
+		}
+	}()
+
+	return socket
+}
+
+func mustCreateTargetServer(c *quicktest.C, ctx context.Context) *targetServer {
+	targetPort := mustFreePort(c)
+	var lc net.ListenConfig
+	socket, err := lc.Listen(ctx, "tcp", fmt.Sprintf("localhost:%d", targetPort))
+	c.Assert(err, quicktest.IsNil, quicktest.Commentf("unable to create target server"))
+
+	rtn := &targetServer{
+		port:        targetPort,
+		socket:      socket,
+		connections: atomic.NewInt64(0),
+		lastError:   atomic.NewError(nil),
+	}
+
+	go func() {
+		for {
+			log.Debug().Msg("target server listening for connection...")
+
+			conn, err := socket.Accept()
+			if err != nil {
+				if strings.HasSuffix(err.Error(), "use of closed network connection") {
+					// happens on socket close during shutdown
+					return
+				}
+				log.Err(err).Msg("target server unable to accept connection")
+				rtn.lastError.Store(err)
+				return
+			}
+			rtn.connections.Inc()
+
+			go rtn.handleConn(conn)
+		}
+	}()
+
+	return rtn
+}
+
+func (t *targetServer) handleConn(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	log.Debug().Msg("target server accepted connection")
+
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		log.Err(err).Msg("target server unable to read")
+		t.lastError.Store(err)
+		return
+	}
+	log.Debug().Msgf("target server read %s", buf[:n])
+
+	response := fmt.Sprintf("goodbye to %s", string(buf[:n]))
+	_, err = conn.Write([]byte(response))
+	if err != nil {
+		log.Err(err).Msg("target server unable to write")
+		t.lastError.Store(err)
+		return
+	}
+
+	log.Debug().Msgf("target server wrote back %s", response)
+
+	err = conn.Close()
+	if err != nil {
+		log.Err(err).Msg("target server couldn't close the connection")
+		t.lastError.Store(err)
+		return
+	}
+
+	log.Debug().Msg("target server closed the connection")
+}
+
+// openConnDialer hands out an already open connection to a SOCKS5 client
+type openConnDialer struct {
+	conn net.Conn
+}
+
+func (o *openConnDialer) Dial(_, _ string) (net.Conn, error) {
+	return o.conn, nil
+}
+
+// anyCredentials accepts any username and password
+type anyCredentials struct{}
+
+func (anyCredentials) Valid(_, _ string) bool {
+	return true
+}
+
+// customTransportDials counts how many times each custom transport address has been dialled
+var customTransportDials sync.Map
+
+// customTransport is a transport registered under a custom scheme, which connects to the raw TCP port
+type customTransport struct {
+	address string
+}
+
+func (t *customTransport) Dial(network, addr string) (net.Conn, error) {
+	return t.DialContext(context.Background(), network, addr)
+}
+
+func (t *customTransport) DialContext(ctx context.Context, network, _ string) (net.Conn, error) {
+	dials, _ := customTransportDials.LoadOrStore(t.address, atomic.NewInt64(0))
+	dials.(*atomic.Int64).Inc()
+
+	var d net.Dialer
+	return d.DialContext(ctx, network, t.address)
+}
+
+// recordingSink records the audit events written to it
+type recordingSink struct {
+	events chan *audit.Event
+}
+
+func (r *recordingSink) Write(event *audit.Event) {
+	r.events <- event
+}
+
+func (r *recordingSink) Close() error {
+	return nil
+}
+
+func (r *recordingSink) mustReceive(c *quicktest.C, ctx context.Context) *audit.Event {
+	select {
+	case event := <-r.events:
+		return event
+	case <-ctx.Done():
+		c.Fatalf("no audit event was written")
+		return nil
+	}
 }
@@ -9,6 +9,7 @@ import (
 	"github.com/cockroachdb/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.encore.dev/emissary/server/audit"
 	"go.encore.dev/emissary/server/http"
 	"go.encore.dev/emissary/server/proxy"
 	"go.encore.dev/emissary/server/tcp"
@@ -23,9 +24,9 @@ func Run(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	// Initialise our logging library
+	// Initialise our logging library, logging to stderr so stdout can carry the audit log
 	log.Logger = zerolog.New(
-		zerolog.NewConsoleWriter(),
+		zerolog.NewConsoleWriter(func(w *zerolog.ConsoleWriter) { w.Out = os.Stderr }),
 	).With().Caller().Timestamp().Logger()
 
 	// Listen for OS level signals to shutdown and then cancel our main context
@@ -44,16 +45,49 @@ func Run(ctx context.Context) error {
 		return err
 	}
 
-	return RunWithConfig(ctx, config)
+	// Open the audit log
+	config.AuditSink, err = audit.NewSink(config.AuditLog)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to open audit log")
+		return err
+	}
+	if config.AuditSink != nil {
+		defer func() {
+			if err := config.AuditSink.Close(); err != nil {
+				log.Err(err).Msg("unable to close audit log")
+			}
+		}()
+	}
+
+	// Reload the config on SIGHUP or when the config file changes
+	live := proxy.NewLiveConfig(config)
+	live.WatchConfig(ctx)
+
+	return RunWithLiveConfig(ctx, live)
 }
 
 // RunWithConfig allows end to end tests to pass in specific test config and run in parallel
 func RunWithConfig(ctx context.Context, config *proxy.Config) error {
+	return RunWithLiveConfig(ctx, proxy.NewLiveConfig(config))
+}
+
+// RunWithLiveConfig runs the servers using the config held by live, which may be reloaded while they are running.
+//
+// Once the context is cancelled, the servers stop accepting new connections and wait for the existing ones to
+// finish, for up to the configured drain timeout, before shutting down.
+func RunWithLiveConfig(ctx context.Context, live *proxy.LiveConfig) error {
+	config := live.Load()
+	drainer := proxy.NewDrainer()
+
+	// The servers keep running while we drain, so they are stopped by their own context
+	serverCtx, stopServers := context.WithCancel(context.Background())
+	defer stopServers()
+
 	// Start our various servers (http / tcp)
-	grp, ctx := errgroup.WithContext(ctx)
+	grp, serverCtx := errgroup.WithContext(serverCtx)
 	if config.HttpPort > 0 {
 		grp.Go(func() error {
-			if err := http.StartServer(ctx, config); err != nil {
+			if err := http.StartServer(serverCtx, live, drainer); err != nil {
 				return errors.Wrap(err, "error running http server")
 			}
 
@@ -63,7 +97,7 @@ func RunWithConfig(ctx context.Context, config *proxy.Config) error {
 
 	if config.TcpPort > 0 {
 		grp.Go(func() error {
-			if err := tcp.StartServer(ctx, config); err != nil {
+			if err := tcp.StartServer(serverCtx, live, drainer); err != nil {
 				return errors.Wrap(err, "error running tcp server")
 			}
 
@@ -71,6 +105,25 @@ func RunWithConfig(ctx context.Context, config *proxy.Config) error {
 		})
 	}
 
+	// Once we're asked to shutdown, or one of the servers has failed, drain the connections and stop the servers
+	grp.Go(func() error {
+		select {
+		case <-ctx.Done():
+		case <-serverCtx.Done():
+		}
+
+		drainTimeout := live.Load().DrainTimeout
+		log.Info().Dur("timeout", drainTimeout).Msg("draining emissary connections")
+		drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if cut := drainer.Drain(drainCtx); cut > 0 {
+			log.Warn().Int("connections", cut).Msg("closed connections which were still open after the drain timeout")
+		}
+
+		stopServers()
+		return nil
+	})
+
 	// Wait for one of the servers to return an error
 	if err := grp.Wait(); err != nil {
 		log.Err(err).Msg("there was a fatal error running emissary")
@@ -7,17 +7,28 @@ import (
 	"go.encore.dev/emissary/server/proxy"
 )
 
-func handleHealth(cfg *proxy.Config) func(w http.ResponseWriter, _ *http.Request) {
-	keys := make([]uint32, 0, len(cfg.AuthKeys))
-	for _, key := range cfg.AuthKeys {
-		keys = append(keys, key.KeyID)
-	}
-	healthResponse, _ := json.Marshal(map[string]interface{}{
-		"ok":      true,
-		"key_ids": keys,
-	})
+func handleHealth(live *proxy.LiveConfig, drainer *proxy.Drainer) func(w http.ResponseWriter, _ *http.Request) {
 	return func(w http.ResponseWriter, _ *http.Request) {
-		w.WriteHeader(http.StatusOK)
+		// The keys may change when the config is reloaded, so build the response on each request
+		cfg := live.Load()
+		keys := make([]uint32, 0, len(cfg.AuthKeys))
+		for _, key := range cfg.AuthKeys {
+			keys = append(keys, key.KeyID)
+		}
+
+		// Report as unhealthy while draining, so load balancers stop sending us new connections
+		draining := drainer.IsDraining()
+		healthResponse, _ := json.Marshal(map[string]interface{}{
+			"ok":       !draining,
+			"draining": draining,
+			"key_ids":  keys,
+		})
+
+		if draining {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
 		_, _ = w.Write(healthResponse)
 	}
 }
@@ -5,21 +5,34 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
+	"go.encore.dev/emissary/internal/emissaryproto"
 	"go.encore.dev/emissary/internal/ws"
 	"go.encore.dev/emissary/server/proxy"
 )
 
 var (
 	upgrader = websocket.Upgrader{
-		Error: respondWithError,
+		Error:           respondWithError,
+		Subprotocols:    []string{ws.HalfCloseSubprotocol, emissaryproto.FramedConnectSubprotocol},
+		WriteBufferPool: ws.WriteBufferPool,
 	}
 )
 
-func handleProxy(config *proxy.Config) http.HandlerFunc {
+func handleProxy(live *proxy.LiveConfig, drainer *proxy.Drainer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		l := log.With().Str("remote", r.RemoteAddr).Str("uri", r.RequestURI).Str("proxy-method", "http").Logger()
 
-		// Upgrade the request to a websocket connection
+		if drainer.IsDraining() {
+			l.Info().Msg("rejecting websocket proxy request as the server is draining")
+			respondWithError(w, r, http.StatusServiceUnavailable, proxy.ErrDraining)
+			return
+		}
+
+		// Upgrade the request to a websocket connection, agreeing to compress messages if the client asks and we're
+		// configured to
+		cfg := live.Load()
+		upgrader := upgrader
+		upgrader.EnableCompression = cfg.WSCompression
 		c, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			l.Err(err).Msg("error upgrading websocket")
@@ -28,14 +41,22 @@ func handleProxy(config *proxy.Config) http.HandlerFunc {
 		}
 
 		// Wrap the Gorilla websocket so we can use it as a net.Conn
-		conn := ws.NewClient(c)
+		conn := ws.NewClientWithOptions(c, cfg.WSWriteOptions())
 		defer func() {
 			if err := conn.Close(); err != nil {
 				l.Err(err).Msg("error closing websocket connection")
 			}
 		}()
+		if upgrader.EnableCompression && ws.DeflateNegotiated(r.Header) {
+			if err := conn.EnableCompression(cfg.WSCompressionLevel); err != nil {
+				l.Err(err).Msg("unable to enable websocket compression")
+				return
+			}
+		}
 
-		if err := config.ServeConn(conn); err != nil {
+		// Older clients expect the connect message to be the only thing in the first websocket message
+		framed := c.Subprotocol() == emissaryproto.FramedConnectSubprotocol || c.Subprotocol() == ws.HalfCloseSubprotocol
+		if err := cfg.ServeConn(conn, proxy.TransportHTTP, framed, drainer); err != nil {
 			l.Err(err).Msg("error serving websocket proxy request")
 			return
 		}
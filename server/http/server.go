@@ -8,12 +8,17 @@ import (
 
 	"github.com/cockroachdb/errors"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
 	"go.encore.dev/emissary/server/proxy"
 )
 
-// StartServer starts listening on the given port for HTTP requests
-func StartServer(ctx context.Context, config *proxy.Config) error {
+// StartServer starts listening on the given port for HTTP requests, until the context is cancelled.
+//
+// While the drainer is draining the server keeps running, so it can report itself as unhealthy,
+// but new proxy connections are rejected.
+func StartServer(ctx context.Context, live *proxy.LiveConfig, drainer *proxy.Drainer) error {
+	config := live.Load()
 	if config.HttpPort <= 0 {
 		return nil
 	}
@@ -21,14 +26,25 @@ func StartServer(ctx context.Context, config *proxy.Config) error {
 	// Setup the router
 	var router = mux.NewRouter()
 	router.Use(PanicRecovery(), RequestLogger())
-	router.Methods("GET").PathPrefix(config.HealthPath).Handler(http.HandlerFunc(handleHealth(config)))
-	router.Methods("GET").PathPrefix("/").Handler(handleProxy(config))
+	if config.HealthPath != "" {
+		router.Methods("GET").PathPrefix(config.HealthPath).Handler(http.HandlerFunc(handleHealth(live, drainer)))
+	}
+	if config.MetricsPath != "" {
+		router.Methods("GET").Path(config.MetricsPath).Handler(promhttp.Handler())
+	}
+	router.Methods("GET").PathPrefix("/").Handler(handleProxy(live, drainer))
+
+	tlsConfig, err := config.NewTLSConfig()
+	if err != nil {
+		return errors.Wrap(err, "unable to load tls config")
+	}
 
 	// Start the server
-	log.Info().Int("port", config.HttpPort).Msg("starting http server")
+	log.Info().Int("port", config.HttpPort).Bool("tls", tlsConfig != nil).Msg("starting http server")
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", config.HttpPort),
-		Handler: router,
+		Addr:      fmt.Sprintf(":%d", config.HttpPort),
+		Handler:   router,
+		TLSConfig: tlsConfig,
 		BaseContext: func(_ net.Listener) context.Context {
 			return ctx
 		},
@@ -45,7 +61,12 @@ func StartServer(ctx context.Context, config *proxy.Config) error {
 		}
 	}()
 
-	err := srv.ListenAndServe()
+	if tlsConfig != nil {
+		// The certificate is provided by the TLS config, so no files need to be passed here
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if err != nil {
 		if errors.Is(err, http.ErrServerClosed) {
 			return nil
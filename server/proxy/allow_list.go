@@ -2,14 +2,40 @@ package proxy
 
 import (
 	"context"
+	"net"
+	"path"
+	"strconv"
+	"strings"
 
 	"github.com/armon/go-socks5"
+	"github.com/cockroachdb/errors"
 	"github.com/rs/zerolog/log"
 )
 
+// AllowedHost is a rule matching proxy targets.
+//
+// The Host may be:
+//   - an exact hostname or IP address, such as `db.internal.example.com` or `10.0.0.5`
+//   - a hostname glob, where each `*` matches within a single label, such as `*.internal.example.com`
+//   - a CIDR block, such as `10.0.0.0/16`, which is matched against the resolved IP of the target
+//
+// The ports the rule matches are given either as a single Port, or as Ports which is a comma separated
+// list of ports and port ranges, such as `80,443,8000-8999`, or `*` for any port. Allow rules must give their ports,
+// while deny rules which don't give any match every port.
+//
+// The Network is either `tcp` (the default) or `udp`, and a rule only matches targets on that network. Deny rules
+// without a Network match targets on every network.
+//
+// Listen rules match the addresses clients may ask the server to listen on, rather than connect to, which must be
+// on the `tcp` network. The Host of a listen rule is matched against the IP address being listened on. Deny rules
+// which aren't listen rules deny listening on the addresses they match too.
 type AllowedHost struct {
-	Host string `json:"host"`
-	Port int    `json:"port"`
+	Host    string `json:"host"`
+	Port    int    `json:"port,omitempty"`
+	Ports   string `json:"ports,omitempty"`
+	Network string `json:"network,omitempty"`
+	Listen  bool   `json:"listen,omitempty"`
+	Deny    bool   `json:"deny,omitempty"` // Deny rules are evaluated before any allow rules
 }
 
 type AllowedProxyTargets []AllowedHost
@@ -17,17 +43,33 @@ type AllowedProxyTargets []AllowedHost
 var _ socks5.RuleSet = (AllowedProxyTargets)(nil)
 
 func (a AllowedProxyTargets) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
-	if req.Command != socks5.ConnectCommand {
-		log.Warn().Uint8("command", req.Command).Msg("only connect commands are allowed")
+	if req.Command != socks5.ConnectCommand && req.Command != socks5.AssociateCommand && req.Command != socks5.BindCommand {
+		log.Warn().Uint8("command", req.Command).Msg("only connect, listen and udp associate commands are allowed")
 		return ctx, false
 	}
 
-	l := log.With().Str("to_host", req.DestAddr.FQDN).Str("to_ip", req.DestAddr.IP.String()).Int("to_port", req.DestAddr.Port).Str("remote", req.RemoteAddr.String()).Logger()
+	lc := log.With().Str("network", requestNetwork(req)).Str("to_host", req.DestAddr.FQDN).Str("to_ip", req.DestAddr.IP.String()).Int("to_port", req.DestAddr.Port).Str("remote", req.RemoteAddr.String())
+	if p := principalFromContext(ctx); p != nil {
+		if p.hasKeyID {
+			lc = lc.Uint32("key_id", p.keyID)
+		}
+		if p.clientIdentity != "" {
+			lc = lc.Str("client_identity", p.clientIdentity)
+		}
+	}
+	l := lc.Logger()
+
+	for _, deniedHost := range a {
+		if deniedHost.Deny && deniedHost.Allow(req) {
+			l.Warn().Str("rule", deniedHost.Host).Msg("denying proxy connection")
+			return ctx, false
+		}
+	}
 
 	for _, allowedHost := range a {
-		if allowedHost.Allow(req) {
-			l.Info().Msg("allowing proxy connection")
-			return ctx, true
+		if !allowedHost.Deny && allowedHost.Allow(req) {
+			l.Info().Str("rule", allowedHost.String()).Msg("allowing proxy connection")
+			return withRule(ctx, allowedHost), true
 		}
 	}
 
@@ -35,7 +77,217 @@ func (a AllowedProxyTargets) Allow(ctx context.Context, req *socks5.Request) (co
 	return ctx, false
 }
 
+// Validate checks all the rules are well formed
+func (a AllowedProxyTargets) Validate() error {
+	for i, host := range a {
+		if err := host.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid proxy target %d", i)
+		}
+	}
+	return nil
+}
+
+// denyRules returns only the deny rules from the list
+func (a AllowedProxyTargets) denyRules() AllowedProxyTargets {
+	var denied AllowedProxyTargets
+	for _, host := range a {
+		if host.Deny {
+			denied = append(denied, host)
+		}
+	}
+	return denied
+}
+
+// AllowedTargets returns the proxy targets allowed for the principal the request was authenticated as.
+//
+// Keys and client certificate identities with their own scope can only reach the targets in that scope, everything
+// else uses AllowedProxyTargets. The deny rules from AllowedProxyTargets always apply.
+func (cfg *Config) AllowedTargets(ctx context.Context) AllowedProxyTargets {
+	if p := principalFromContext(ctx); p != nil && p.hasKeyID {
+		if targets, found := cfg.KeyScopes[p.keyID]; found {
+			return append(cfg.AllowedProxyTargets.denyRules(), targets...)
+		}
+	} else if p != nil && p.clientIdentity != "" {
+		if targets, found := cfg.ClientScopes[p.clientIdentity]; found {
+			return append(cfg.AllowedProxyTargets.denyRules(), targets...)
+		}
+	}
+
+	return cfg.AllowedProxyTargets
+}
+
+// Allow reports whether the rule matches the request
 func (a AllowedHost) Allow(req *socks5.Request) bool {
-	return a.Port == req.DestAddr.Port && (a.Host == req.DestAddr.FQDN ||
-		(a.Host == req.DestAddr.IP.String() && len(req.DestAddr.IP) > 0))
+	return a.matchesCommand(req.Command) && a.matchesNetwork(requestNetwork(req)) &&
+		a.matchesPort(req.DestAddr.Port) && a.matchesHost(req.DestAddr)
+}
+
+// matchesCommand reports whether the rule is for listening, or connecting, as the request is. Deny rules which aren't
+// listen rules match both.
+func (a AllowedHost) matchesCommand(command uint8) bool {
+	return a.Listen == (command == socks5.BindCommand) || (a.Deny && !a.Listen)
+}
+
+// String describes the rule, such as `tcp *.internal.example.com:80,443` or `listen tcp 10.0.0.0/8:8000-8999`
+func (a AllowedHost) String() string {
+	network := a.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if a.Listen {
+		network = "listen " + network
+	}
+
+	ports := a.Ports
+	if ports == "" && a.Port == 0 {
+		ports = "*"
+	} else if ports == "" {
+		ports = strconv.Itoa(a.Port)
+	}
+	return network + " " + net.JoinHostPort(a.Host, ports)
+}
+
+// Validate checks the rule is well formed
+func (a AllowedHost) Validate() error {
+	if a.Host == "" {
+		return errors.New("no host given")
+	}
+	if strings.Contains(a.Host, "/") {
+		if _, _, err := net.ParseCIDR(a.Host); err != nil {
+			return errors.Wrapf(err, "invalid cidr block %q", a.Host)
+		}
+	} else if isHostGlob(a.Host) {
+		if _, err := path.Match(a.Host, ""); err != nil {
+			return errors.Wrapf(err, "invalid host glob %q", a.Host)
+		}
+	}
+
+	if a.Network != "" && a.Network != "tcp" && a.Network != "udp" {
+		return errors.Newf("invalid network %q, must be tcp or udp", a.Network)
+	}
+	if a.Listen && a.Network == "udp" {
+		return errors.New("listen rules must be for the tcp network")
+	}
+	if a.Port != 0 && a.Ports != "" {
+		return errors.New("only one of port or ports can be given")
+	}
+	if a.Port == 0 && a.Ports == "" && !a.Deny {
+		return errors.New("no port or ports given, use `\"ports\": \"*\"` to allow any port")
+	}
+	if a.Port < 0 || a.Port > 65535 {
+		return errors.Newf("invalid port %d", a.Port)
+	}
+	if _, err := parsePorts(a.Ports); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (a AllowedHost) matchesHost(dest *socks5.AddrSpec) bool {
+	// CIDR blocks are matched against the resolved IP
+	if strings.Contains(a.Host, "/") {
+		_, block, err := net.ParseCIDR(a.Host)
+		return err == nil && len(dest.IP) > 0 && block.Contains(dest.IP)
+	}
+
+	if a.Host == dest.IP.String() && len(dest.IP) > 0 {
+		return true
+	}
+
+	if dest.FQDN == "" {
+		return false
+	}
+	if isHostGlob(a.Host) {
+		return matchHostGlob(a.Host, dest.FQDN)
+	}
+	return strings.EqualFold(strings.TrimSuffix(a.Host, "."), strings.TrimSuffix(dest.FQDN, "."))
+}
+
+func (a AllowedHost) matchesNetwork(network string) bool {
+	if a.Network == "" {
+		return network == "tcp" || a.Deny
+	}
+	return a.Network == network
+}
+
+// requestNetwork returns the network a request is for; UDP associate requests are for udp targets
+func requestNetwork(req *socks5.Request) string {
+	if req.Command == socks5.AssociateCommand {
+		return "udp"
+	}
+	return "tcp"
+}
+
+func (a AllowedHost) matchesPort(port int) bool {
+	if a.Ports == "" {
+		// Deny rules without any ports deny the whole host
+		return a.Port == port || (a.Deny && a.Port == 0)
+	}
+
+	ranges, err := parsePorts(a.Ports)
+	if err != nil {
+		return false
+	}
+	for _, r := range ranges {
+		if port >= r.from && port <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+func isHostGlob(host string) bool {
+	return strings.ContainsAny(host, "*?[")
+}
+
+// matchHostGlob matches a hostname against a glob, label by label, so `*` never matches across a `.`
+func matchHostGlob(pattern, host string) bool {
+	patternLabels := strings.Split(strings.ToLower(strings.TrimSuffix(pattern, ".")), ".")
+	hostLabels := strings.Split(strings.ToLower(strings.TrimSuffix(host, ".")), ".")
+	if len(patternLabels) != len(hostLabels) {
+		return false
+	}
+
+	for i, label := range patternLabels {
+		if matched, err := path.Match(label, hostLabels[i]); err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+type portRange struct {
+	from, to int
+}
+
+// parsePorts parses a comma separated list of ports and port ranges
+func parsePorts(ports string) ([]portRange, error) {
+	if ports == "" {
+		return nil, nil
+	}
+	if ports == "*" {
+		return []portRange{{1, 65535}}, nil
+	}
+
+	var ranges []portRange
+	for _, part := range strings.Split(ports, ",") {
+		part = strings.TrimSpace(part)
+		bounds := strings.SplitN(part, "-", 2)
+
+		fromPort, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, errors.Newf("invalid port %q", part)
+		}
+		toPort, err := strconv.Atoi(strings.TrimSpace(bounds[len(bounds)-1]))
+		if err != nil {
+			return nil, errors.Newf("invalid port %q", part)
+		}
+		if fromPort < 1 || toPort > 65535 || fromPort > toPort {
+			return nil, errors.Newf("invalid port range %q", part)
+		}
+
+		ranges = append(ranges, portRange{fromPort, toPort})
+	}
+	return ranges, nil
 }
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/armon/go-socks5"
+)
+
+func TestAllowedProxyTargets_Allow(t *testing.T) {
+	t.Parallel()
+
+	targets := AllowedProxyTargets{
+		{Host: "db.example.com", Port: 5432},
+		{Host: "*.internal.example.com", Ports: "5432,6379"},
+		{Host: "cache-*.example.com", Ports: "6379"},
+		{Host: "10.0.0.0/16", Ports: "8000-8999"},
+		{Host: "192.168.1.10", Port: 443},
+		{Host: "dns.internal.example.com", Port: 53, Network: "udp"},
+		{Host: "statsd.internal.example.com", Port: 8125, Network: "tcp"},
+		{Host: "10.2.0.0/16", Ports: "9000-9099", Listen: true},
+		{Host: "secret.internal.example.com", Ports: "*", Deny: true},
+		{Host: "10.0.5.0/24", Ports: "*", Deny: true},
+		{Host: "10.0.6.0/24", Deny: true},
+		{Host: "10.3.0.0/16", Ports: "*"},
+		{Host: "10.3.0.0/16", Ports: "*", Network: "udp"},
+		{Host: "10.3.5.0/24", Deny: true},
+		{Host: "10.3.6.0/24", Ports: "*", Network: "udp", Deny: true},
+		{Host: "10.3.0.0/16", Ports: "*", Listen: true},
+		{Host: "10.3.7.0/24", Ports: "*", Listen: true, Deny: true},
+	}
+
+	tests := []struct {
+		name    string
+		command uint8
+		fqdn    string
+		ip      string
+		port    int
+		allowed bool
+	}{
+		{name: "exact host", fqdn: "db.example.com", ip: "10.1.0.1", port: 5432, allowed: true},
+		{name: "exact host is case insensitive", fqdn: "DB.Example.com", ip: "10.1.0.1", port: 5432, allowed: true},
+		{name: "exact host wrong port", fqdn: "db.example.com", ip: "10.1.0.1", port: 5433, allowed: false},
+		{name: "unknown host", fqdn: "www.example.com", ip: "10.1.0.1", port: 5432, allowed: false},
+		{name: "glob host", fqdn: "pg.internal.example.com", ip: "10.1.0.1", port: 5432, allowed: true},
+		{name: "glob host second port in list", fqdn: "redis.internal.example.com", ip: "10.1.0.1", port: 6379, allowed: true},
+		{name: "glob host port not in list", fqdn: "pg.internal.example.com", ip: "10.1.0.1", port: 22, allowed: false},
+		{name: "glob does not cross labels", fqdn: "a.b.internal.example.com", ip: "10.1.0.1", port: 5432, allowed: false},
+		{name: "glob does not match parent", fqdn: "internal.example.com", ip: "10.1.0.1", port: 5432, allowed: false},
+		{name: "glob within label", fqdn: "cache-1.example.com", ip: "10.1.0.1", port: 6379, allowed: true},
+		{name: "cidr start of range", ip: "10.0.1.1", port: 8000, allowed: true},
+		{name: "cidr end of range", ip: "10.0.255.1", port: 8999, allowed: true},
+		{name: "cidr outside of port range", ip: "10.0.1.1", port: 9000, allowed: false},
+		{name: "cidr outside of block", ip: "10.1.1.1", port: 8000, allowed: false},
+		{name: "cidr matches resolved ip", fqdn: "app.example.com", ip: "10.0.1.1", port: 8080, allowed: true},
+		{name: "exact ip", ip: "192.168.1.10", port: 443, allowed: true},
+		{name: "exact ip wrong port", ip: "192.168.1.10", port: 80, allowed: false},
+		{name: "denied host overrides glob", fqdn: "secret.internal.example.com", ip: "10.1.0.1", port: 5432, allowed: false},
+		{name: "denied cidr overrides cidr", ip: "10.0.5.1", port: 8000, allowed: false},
+		{name: "denied cidr matches resolved ip", fqdn: "db.example.com", ip: "10.0.5.1", port: 5432, allowed: false},
+		{name: "denied cidr without ports denies every port", ip: "10.0.6.1", port: 8000, allowed: false},
+		{name: "non connect commands", command: socks5.BindCommand, fqdn: "db.example.com", ip: "10.1.0.1", port: 5432, allowed: false},
+		{name: "udp target", command: socks5.AssociateCommand, fqdn: "dns.internal.example.com", ip: "10.1.0.53", port: 53, allowed: true},
+		{name: "udp target over tcp", fqdn: "dns.internal.example.com", ip: "10.1.0.53", port: 53, allowed: false},
+		{name: "tcp target over udp", command: socks5.AssociateCommand, fqdn: "db.example.com", ip: "10.1.0.1", port: 5432, allowed: false},
+		{name: "explicit tcp target", fqdn: "statsd.internal.example.com", ip: "10.1.0.2", port: 8125, allowed: true},
+		{name: "explicit tcp target over udp", command: socks5.AssociateCommand, fqdn: "statsd.internal.example.com", ip: "10.1.0.2", port: 8125, allowed: false},
+		{name: "udp within allowed cidr", command: socks5.AssociateCommand, ip: "10.3.1.1", port: 53, allowed: true},
+		{name: "deny rule without network denies tcp", ip: "10.3.5.1", port: 53, allowed: false},
+		{name: "deny rule without network denies udp", command: socks5.AssociateCommand, ip: "10.3.5.1", port: 53, allowed: false},
+		{name: "udp deny rule denies udp", command: socks5.AssociateCommand, ip: "10.3.6.1", port: 53, allowed: false},
+		{name: "udp deny rule does not deny tcp", ip: "10.3.6.1", port: 53, allowed: true},
+		{name: "listen within allowed cidr", command: socks5.BindCommand, ip: "10.3.1.1", port: 8080, allowed: true},
+		{name: "deny rule denies listen", command: socks5.BindCommand, ip: "10.3.5.1", port: 8080, allowed: false},
+		{name: "listen deny rule denies listen", command: socks5.BindCommand, ip: "10.3.7.1", port: 8080, allowed: false},
+		{name: "listen deny rule does not deny connect", ip: "10.3.7.1", port: 8080, allowed: true},
+		{name: "listen address", command: socks5.BindCommand, ip: "10.2.0.4", port: 9000, allowed: true},
+		{name: "listen address wrong port", command: socks5.BindCommand, ip: "10.2.0.4", port: 9100, allowed: false},
+		{name: "listen rule does not allow connect", ip: "10.2.0.4", port: 9000, allowed: false},
+		{name: "connect rule does not allow listen", command: socks5.BindCommand, ip: "10.0.1.1", port: 8080, allowed: false},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			command := test.command
+			if command == 0 {
+				command = socks5.ConnectCommand
+			}
+			req := &socks5.Request{
+				Command:    command,
+				RemoteAddr: &socks5.AddrSpec{IP: net.ParseIP("127.0.0.1"), Port: 12345},
+				DestAddr:   &socks5.AddrSpec{FQDN: test.fqdn, IP: net.ParseIP(test.ip), Port: test.port},
+			}
+
+			if _, allowed := targets.Allow(context.Background(), req); allowed != test.allowed {
+				t.Fatalf("expected allowed to be %v, got %v", test.allowed, allowed)
+			}
+		})
+	}
+}
+
+func TestAllowedProxyTargets_Validate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		host  AllowedHost
+		valid bool
+	}{
+		{name: "exact host", host: AllowedHost{Host: "db.example.com", Port: 5432}, valid: true},
+		{name: "cidr with port list", host: AllowedHost{Host: "10.0.0.0/16", Ports: "80, 443,8000-8999"}, valid: true},
+		{name: "any port", host: AllowedHost{Host: "*.example.com", Ports: "*"}, valid: true},
+		{name: "no port", host: AllowedHost{Host: "db.example.com"}, valid: false},
+		{name: "deny rule without ports", host: AllowedHost{Host: "10.0.5.0/24", Deny: true}, valid: true},
+		{name: "no host", host: AllowedHost{Port: 5432}, valid: false},
+		{name: "invalid cidr", host: AllowedHost{Host: "10.0.0.0/33", Port: 5432}, valid: false},
+		{name: "invalid glob", host: AllowedHost{Host: "[.example.com", Port: 5432}, valid: false},
+		{name: "port and ports", host: AllowedHost{Host: "db.example.com", Port: 5432, Ports: "5432"}, valid: false},
+		{name: "invalid port", host: AllowedHost{Host: "db.example.com", Port: 70000}, valid: false},
+		{name: "invalid port list", host: AllowedHost{Host: "db.example.com", Ports: "80,http"}, valid: false},
+		{name: "backwards port range", host: AllowedHost{Host: "db.example.com", Ports: "9000-8000"}, valid: false},
+		{name: "udp network", host: AllowedHost{Host: "dns.example.com", Port: 53, Network: "udp"}, valid: true},
+		{name: "listen rule", host: AllowedHost{Host: "10.0.0.0/8", Port: 9000, Listen: true}, valid: true},
+		{name: "udp listen rule", host: AllowedHost{Host: "10.0.0.0/8", Port: 9000, Listen: true, Network: "udp"}, valid: false},
+		{name: "invalid network", host: AllowedHost{Host: "dns.example.com", Port: 53, Network: "sctp"}, valid: false},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := AllowedProxyTargets{test.host}.Validate()
+			if test.valid && err != nil {
+				t.Fatalf("expected rule to be valid, got: %v", err)
+			} else if !test.valid && err == nil {
+				t.Fatalf("expected rule to be invalid")
+			}
+		})
+	}
+}
+
+func TestAllowedHost_String(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		host     AllowedHost
+		expected string
+	}{
+		{host: AllowedHost{Host: "db.example.com", Port: 5432}, expected: "tcp db.example.com:5432"},
+		{host: AllowedHost{Host: "*.example.com", Ports: "80,443"}, expected: "tcp *.example.com:80,443"},
+		{host: AllowedHost{Host: "dns.example.com", Port: 53, Network: "udp"}, expected: "udp dns.example.com:53"},
+		{host: AllowedHost{Host: "10.0.0.0/8", Ports: "8000-8999", Listen: true}, expected: "listen tcp 10.0.0.0/8:8000-8999"},
+		{host: AllowedHost{Host: "fd00::/8", Ports: "*"}, expected: "tcp [fd00::/8]:*"},
+		{host: AllowedHost{Host: "10.0.5.0/24", Deny: true}, expected: "tcp 10.0.5.0/24:*"},
+	}
+
+	for _, test := range tests {
+		if got := test.host.String(); got != test.expected {
+			t.Errorf("expected %+v to be described as %q, got %q", test.host, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/rs/zerolog/log"
+	"go.encore.dev/emissary/internal/emissaryproto"
+	"go.encore.dev/emissary/server/audit"
+)
+
+// tunnel tracks a single SOCKS5 connection from a client, so an audit event can be emitted for it once it closes
+type tunnel struct {
+	cfg       *Config
+	principal *principal
+
+	mu        sync.Mutex
+	event     audit.Event
+	target    *meteredConn                  // the connection to the target, once it has been dialed
+	rejection *emissaryproto.HandshakeError // why the handshake was rejected, to tell the client
+
+	// the bytes received from and sent to the connections accepted on a listener, once they have closed
+	acceptedIn, acceptedOut int64
+}
+
+func (cfg *Config) newTunnel(p *principal, transport string, remote net.Addr) *tunnel {
+	return &tunnel{
+		cfg:       cfg,
+		principal: p,
+		event: audit.Event{
+			ClientIdentity: p.clientIdentity,
+			RemoteAddr:     remote.String(),
+			Transport:      transport,
+			Network:        "tcp",
+			Start:          time.Now().UTC(),
+		},
+	}
+}
+
+// requested records the target the client asked for, and the IP it resolved to
+func (t *tunnel) requested(target string, ip net.IP) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.event.Target = target
+	if len(ip) > 0 {
+		t.event.ResolvedIP = ip.String()
+	}
+}
+
+// decided records what was decided about the tunnel
+func (t *tunnel) decided(decision audit.Decision) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.event.Decision = decision
+}
+
+// rejected records why the handshake was rejected, so the client can be told once the SOCKS5 server replies
+func (t *tunnel) rejected(reason emissaryproto.HandshakeError_Reason, message string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rejection = &emissaryproto.HandshakeError{Reason: reason, Message: message}
+}
+
+// dial is used by the SOCKS5 server to connect to the target, once it has been allowed
+func (t *tunnel) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := t.cfg.dialTarget(ctx, network, addr)
+	if err != nil {
+		t.decided(audit.DecisionDialFailed)
+		t.rejected(emissaryproto.HandshakeError_TARGET_UNREACHABLE, "unable to connect to target")
+		return nil, err
+	}
+
+	t.mu.Lock()
+	t.event.Decision = audit.DecisionAllowed
+	t.target = conn
+	t.mu.Unlock()
+
+	return conn, nil
+}
+
+// listen is used to listen on the address a client asked for, once it has been allowed
+func (t *tunnel) listen(ctx context.Context, addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		t.decided(audit.DecisionListenFailed)
+		t.rejected(emissaryproto.HandshakeError_LISTEN_FAILED, "unable to listen on address")
+		return nil, errors.Wrap(err, "unable to listen")
+	}
+
+	t.decided(audit.DecisionAllowed)
+	return listener, nil
+}
+
+// accepted records the bytes transferred over a connection accepted on a listener, once it has closed
+func (t *tunnel) accepted(conn *meteredConn) {
+	in, out := conn.bytes()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.acceptedIn += in
+	t.acceptedOut += out
+}
+
+// finish emits the audit event for the tunnel, with the error it closed with
+func (t *tunnel) finish(err error) {
+	sink := t.cfg.AuditSink
+	if sink == nil {
+		return
+	}
+
+	t.mu.Lock()
+	event := t.event
+	target := t.target
+	event.BytesIn, event.BytesOut = t.acceptedIn, t.acceptedOut
+	t.mu.Unlock()
+
+	event.End = time.Now().UTC()
+	if t.principal.hasKeyID {
+		keyID := t.principal.keyID
+		event.KeyID = &keyID
+	}
+	if event.Decision == "" {
+		if t.principal.hasKeyID || t.principal.clientIdentity != "" {
+			event.Decision = audit.DecisionIncomplete
+		} else {
+			event.Decision = audit.DecisionUnauthenticated
+		}
+	}
+	if target != nil {
+		event.BytesIn, event.BytesOut = target.bytes()
+	}
+
+	event.CloseReason = "closed"
+	if err != nil {
+		event.CloseReason = err.Error()
+	}
+
+	sink.Write(&event)
+}
+
+// tunnelConn is the client side of a tunnel, which tells the client why its handshake was rejected when the SOCKS5
+// server closes it, as the SOCKS5 reply only has room for a generic reason
+type tunnelConn struct {
+	net.Conn
+	tunnel *tunnel
+}
+
+func (c *tunnelConn) Close() error {
+	c.tunnel.mu.Lock()
+	rejection := c.tunnel.rejection
+	c.tunnel.mu.Unlock()
+
+	if rejection != nil {
+		if err := emissaryproto.WriteHandshakeError(c.Conn, rejection.Reason, rejection.Message); err != nil {
+			log.Debug().Err(err).Msg("unable to tell client why its handshake was rejected")
+		}
+	}
+	return c.Conn.Close() //nolint:wrapcheck
+}
+
+// CloseWrite half closes the underlying connection if it supports it, so the SOCKS5 proxy can still do so.
+func (c *tunnelConn) CloseWrite() error {
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return errors.Wrap(closer.CloseWrite(), "unable to close write")
+	}
+	return nil
+}
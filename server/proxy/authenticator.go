@@ -1,29 +1,153 @@
 package proxy
 
 import (
+	"context"
 	"encoding/base64"
+	"net/http"
 
 	"github.com/armon/go-socks5"
+	"github.com/cockroachdb/errors"
 	"github.com/rs/zerolog/log"
 	"go.encore.dev/emissary/internal/auth"
+	"go.encore.dev/emissary/internal/emissaryproto"
+	"go.encore.dev/emissary/server/audit"
 )
 
+// principal records who a connection has been authenticated as
+type principal struct {
+	keyID          uint32
+	hasKeyID       bool   // true once the connection has authenticated using one of the auth keys
+	clientIdentity string // the identity from a verified client certificate, if the client presented one
+}
+
+type principalContextKey struct{}
+
+// withPrincipal returns a context recording who the request was authenticated as
+func withPrincipal(ctx context.Context, p *principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, p)
+}
+
+// principalFromContext returns who the request was authenticated as, or nil if it's not known
+func principalFromContext(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalContextKey{}).(*principal)
+	return p
+}
+
 type authenticator struct {
-	cfg   *Config
-	nonce []byte
+	cfg       *Config
+	nonce     []byte
+	principal *principal
+	tunnel    *tunnel // the tunnel being authenticated, if authenticating a single SOCKS5 connection
 }
 
 var _ socks5.CredentialStore = (*authenticator)(nil)
 
-func newAuthenticator(cfg *Config, nonce []byte) []socks5.Authenticator {
-	return []socks5.Authenticator{&socks5.UserPassAuthenticator{Credentials: &authenticator{cfg: cfg, nonce: nonce}}}
+func newAuthenticator(cfg *Config, nonce []byte, t *tunnel) []socks5.Authenticator {
+	methods := []socks5.Authenticator{
+		&socks5.UserPassAuthenticator{Credentials: &authenticator{cfg: cfg, nonce: nonce, principal: t.principal, tunnel: t}},
+	}
+
+	// Clients authenticated by their certificate do not need to send a hmac
+	if t.principal.clientIdentity != "" {
+		methods = append(methods, &socks5.NoAuthAuthenticator{})
+	}
+
+	return methods
 }
 
 func (a authenticator) Valid(user, password string) bool {
-	if err := auth.ValidateRequest(a.cfg.AuthKeys, user, base64.RawStdEncoding.EncodeToString(a.nonce), password); err != nil {
+	status := a.authenticate(user, password)
+	if status == emissaryproto.SessionAuthSuccess {
+		return true
+	}
+
+	if a.tunnel != nil {
+		switch status {
+		case emissaryproto.SessionAuthUnknownKeyID:
+			a.tunnel.rejected(emissaryproto.HandshakeError_UNKNOWN_KEY_ID, "unknown key id")
+		case emissaryproto.SessionAuthClockSkew:
+			a.tunnel.rejected(emissaryproto.HandshakeError_CLOCK_SKEW, "credentials signed outside of the allowed clock skew")
+		case emissaryproto.SessionAuthReplayed:
+			a.tunnel.rejected(emissaryproto.HandshakeError_UNAUTHORIZED, "credentials have already been used")
+		default:
+			a.tunnel.rejected(emissaryproto.HandshakeError_UNAUTHORIZED, "invalid credentials")
+		}
+	}
+	return false
+}
+
+// authenticate checks the date and hmac the client sent, returning why they were rejected if they were
+func (a authenticator) authenticate(date, signature string) emissaryproto.SessionAuthStatus {
+	if a.principal.clientIdentity != "" {
+		log.Debug().Str("client_identity", a.principal.clientIdentity).Msg("emissary connection authenticated by client certificate")
+		handshakes.WithLabelValues(handshakeSuccess).Inc()
+		return emissaryproto.SessionAuthSuccess
+	}
+
+	keyID, err := auth.ValidateRequest(a.cfg.AuthKeys, date, base64.RawStdEncoding.EncodeToString(a.nonce), signature, a.cfg.MaxClockSkew)
+	if err != nil {
 		log.Warn().Err(err).Msg("invalid hmac sent for emissary connection")
-		return false
+		switch {
+		case errors.Is(err, auth.ErrClockSkew):
+			handshakes.WithLabelValues(handshakeClockSkew).Inc()
+			return emissaryproto.SessionAuthClockSkew
+		case errors.Is(err, auth.ErrUnknownKeyID):
+			handshakes.WithLabelValues(handshakeUnknownKeyID).Inc()
+			return emissaryproto.SessionAuthUnknownKeyID
+		default:
+			handshakes.WithLabelValues(handshakeBadHMAC).Inc()
+		}
+		return emissaryproto.SessionAuthFailure
+	}
+
+	// The signature is only valid while its date is within the allowed skew, so we only need to remember it until then
+	maxSkew := a.cfg.MaxClockSkew
+	if maxSkew <= 0 {
+		maxSkew = auth.DefaultMaxClockSkew
+	}
+	signedAt, _ := http.ParseTime(date)
+	if a.cfg.replayCache().seen(keyID, date, signature, signedAt.Add(maxSkew)) {
+		log.Warn().Uint32("key_id", keyID).Msg("replayed hmac sent for emissary connection")
+		handshakes.WithLabelValues(handshakeReplayed).Inc()
+		return emissaryproto.SessionAuthReplayed
 	}
 
-	return true
+	handshakes.WithLabelValues(handshakeSuccess).Inc()
+	a.principal.keyID = keyID
+	a.principal.hasKeyID = true
+	return emissaryproto.SessionAuthSuccess
+}
+
+// scopedRules evaluates the proxy targets which are allowed for the principal a connection was authenticated as
+type scopedRules struct {
+	cfg       *Config
+	principal *principal
+	tunnel    *tunnel
+}
+
+var _ socks5.RuleSet = scopedRules{}
+
+func (s scopedRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	target := requestTarget(req)
+	s.tunnel.requested(target, req.DestAddr.IP)
+
+	// By the time the rules are checked, any hostname has been resolved, so we can check the IP we're about to dial
+	if forbidden := s.cfg.forbiddenNetwork(req.DestAddr.IP); forbidden != nil {
+		log.Warn().Str("to_host", req.DestAddr.FQDN).Str("to_ip", req.DestAddr.IP.String()).Int("to_port", req.DestAddr.Port).
+			Str("remote", req.RemoteAddr.String()).Str("forbidden_network", forbidden.String()).
+			Msg("disallowing proxy connection to forbidden network")
+		handshakes.WithLabelValues(handshakeForbiddenNetwork).Inc()
+		s.tunnel.decided(audit.DecisionForbiddenNetwork)
+		s.tunnel.rejected(emissaryproto.HandshakeError_TARGET_NOT_ALLOWED, "target is in a forbidden network")
+		return ctx, false
+	}
+
+	ctx = withPrincipal(ctx, s.principal)
+	ctx, allowed := s.cfg.AllowedTargets(ctx).Allow(ctx, req)
+	if !allowed {
+		handshakes.WithLabelValues(handshakeRuleDenied).Inc()
+		s.tunnel.decided(audit.DecisionDenied)
+		s.tunnel.rejected(emissaryproto.HandshakeError_TARGET_NOT_ALLOWED, "target is not allowed")
+	}
+	return ctx, allowed
 }
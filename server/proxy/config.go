@@ -1,24 +1,81 @@
 package proxy
 
 import (
+	"compress/flate"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"net"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/joho/godotenv"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 	"go.encore.dev/emissary/internal/auth"
+	"go.encore.dev/emissary/internal/ws"
+	"go.encore.dev/emissary/server/audit"
 )
 
+// KeyScopes maps a key ID to the proxy targets which that key is allowed to reach
+type KeyScopes map[uint32]AllowedProxyTargets
+
+// ClientScopes maps the name a client certificate identified the client by to the proxy targets which that client is
+// allowed to reach
+type ClientScopes map[string]AllowedProxyTargets
+
+// authKeyConfig is how an auth key is configured, allowing it to optionally have its own scope
+type authKeyConfig struct {
+	auth.Key
+	AllowedProxyTargets AllowedProxyTargets `json:"allowed_proxy_targets,omitempty"`
+}
+
 type Config struct {
 	HttpPort            int                 // What port should this server listen for HTTP/websocket connections on (0 == disabled)
 	TcpPort             int                 // What port should this server listen for raw TCP connections on (0 == disabled)
 	AuthKeys            auth.Keys           // What auth keys can be used when talking with this Emissary server
+	MaxClockSkew        time.Duration       // How far from our clock a client may sign its auth at; zero means auth.DefaultMaxClockSkew
 	AllowedProxyTargets AllowedProxyTargets // What proxy targets are allowed through this Emissary server
+	KeyScopes           KeyScopes           // Which keys are restricted to their own proxy targets, rather than AllowedProxyTargets
+	ClientScopes        ClientScopes        // Which client certificate identities are restricted to their own proxy targets, rather than AllowedProxyTargets
 	DNSServers          []string            // The DNS server IPs to use; nil means the system default
+	ForbiddenNetworks   []*net.IPNet        // Networks which can never be proxied to, checked against the resolved IP of a target
 	HealthPath          string              // The path to use for health checks
+	DrainTimeout        time.Duration       // How long to wait for connections to finish when shutting down, before closing them
+	MetricsPath         string              // The path to serve Prometheus metrics on; empty (the default) means metrics are not served
+	TLSCertFile         string              // The PEM encoded certificate to serve TLS with; empty means TLS is terminated elsewhere
+	TLSKeyFile          string              // The PEM encoded private key for TLSCertFile
+	TLSCertificate      *tls.Certificate    // An in-memory certificate to serve TLS with, used instead of TLSCertFile when set
+	TLSClientCAFile     string              // The PEM encoded CA bundle to verify client certificates against; empty means clients must use a hmac
+	TLSClientCAs        *x509.CertPool      // An in-memory CA pool to verify client certificates against, used instead of TLSClientCAFile when set
+	TLSAllowedClients   []string            // The common names or SANs of client certificates which are allowed; empty allows any verified certificate
+	AuditLog            string              // Where to write the audit log of tunnels, see audit.NewSink; empty means no audit log
+	AuditSink           audit.Sink          // The sink audit events are written to, created from AuditLog when the server starts
+	WSFlushDelay        time.Duration       // How long websocket writes wait to be coalesced into one message; zero sends each write straight away
+	WSMaxFrameSize      int                 // The largest websocket message a write is sent as, with larger writes split; zero never splits writes
+	WSCompression       bool                // Whether to agree to compress websocket messages for clients which ask for it
+	WSCompressionLevel  int                 // The flate level, from -2 (flate.HuffmanOnly) to 9, to compress websocket messages at when WSCompression is set
+
+	replaysOnce sync.Once
+	replays     *replayCache // The signatures clients have already used, shared across config reloads
+}
+
+// replayCache returns the cache of signatures clients have already used
+func (cfg *Config) replayCache() *replayCache {
+	cfg.replaysOnce.Do(func() {
+		if cfg.replays == nil {
+			cfg.replays = newReplayCache(MaxReplayCacheEntries)
+		}
+	})
+	return cfg.replays
+}
+
+// WSWriteOptions returns how writes to websocket clients are sent as websocket messages
+func (cfg *Config) WSWriteOptions() ws.WriteOptions {
+	return ws.WriteOptions{FlushDelay: cfg.WSFlushDelay, MaxFrameSize: cfg.WSMaxFrameSize}
 }
 
 // LoadConfig performs setup for the proxy layer and returns an error if we cannot initialise
@@ -31,15 +88,26 @@ func LoadConfig(_ context.Context) (*Config, error) {
 	// Now configure viper with our default config and bind it to read from the environment
 	viper.SetDefault("http_port", 8080)
 	viper.SetDefault("health_path", "/healthz")
+	viper.SetDefault("drain_timeout", 30*time.Second)
+	viper.SetDefault("max_clock_skew", auth.DefaultMaxClockSkew)
+	viper.SetDefault("ws_compression_level", flate.DefaultCompression)
 	viper.SetEnvPrefix("emissary")
 	viper.AutomaticEnv()
 
 	// Read the config file
-	viper.SetConfigFile("config")
+	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath("/etc/emissary")
 	viper.AddConfigPath("$HOME/.emissary")
 	viper.AddConfigPath(".")
+
+	return readConfig()
+}
+
+// readConfig reads the config file and builds a Config from it and the environment.
+//
+// It is called by both LoadConfig and when the config is reloaded, after viper has been set up.
+func readConfig() (*Config, error) {
 	if err := viper.ReadInConfig(); err != nil && !errors.Is(err, os.ErrNotExist) {
 		// Ignore file not found errors
 		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
@@ -55,33 +123,111 @@ func LoadConfig(_ context.Context) (*Config, error) {
 			return nil, errors.Wrap(err, "unable to unmarshal allowed proxy targets")
 		}
 	}
-	if len(allowedProxyTargets) == 0 {
-		return nil, errors.New("no allowed proxy targets loaded from environment")
+
+	if err := allowedProxyTargets.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid allowed proxy targets")
 	}
 
 	// Load the auth keys
-	authKeys := make(auth.Keys, 0)
+	authKeyConfigs := make([]authKeyConfig, 0)
 	authKeysJSON := viper.GetString("auth_keys")
 	if authKeysJSON != "" {
-		if err := json.Unmarshal([]byte(authKeysJSON), &authKeys); err != nil {
+		if err := json.Unmarshal([]byte(authKeysJSON), &authKeyConfigs); err != nil {
 			return nil, errors.Wrap(err, "unable to unmarshal auth keys")
 		}
 	}
-	if len(authKeys) == 0 {
+	if len(authKeyConfigs) == 0 {
 		return nil, errors.New("no auth keys loaded from environment")
 	}
 
-	log.Info().
-		Int("num_allowed_proxy_targets", len(allowedProxyTargets)).
-		Int("num_auth_keys", len(authKeys)).
-		Msg("loaded emissary proxy config")
+	authKeys := make(auth.Keys, 0, len(authKeyConfigs))
+	keyScopes := make(KeyScopes)
+	for _, key := range authKeyConfigs {
+		authKeys = append(authKeys, key.Key)
+		if len(key.AllowedProxyTargets) > 0 {
+			if err := key.AllowedProxyTargets.Validate(); err != nil {
+				return nil, errors.Wrapf(err, "invalid allowed proxy targets for key %d", key.KeyID)
+			}
+			keyScopes[key.KeyID] = key.AllowedProxyTargets
+		}
+	}
 
-	return &Config{
+	// Load the scopes of clients authenticated by certificate
+	clientScopes := make(ClientScopes)
+	clientScopesJSON := viper.GetString("client_scopes")
+	if clientScopesJSON != "" {
+		if err := json.Unmarshal([]byte(clientScopesJSON), &clientScopes); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal client scopes")
+		}
+	}
+	for identity, targets := range clientScopes {
+		if err := targets.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid allowed proxy targets for client %q", identity)
+		}
+	}
+
+	if len(allowedProxyTargets) == 0 && len(keyScopes) == 0 && len(clientScopes) == 0 {
+		return nil, errors.New("no allowed proxy targets loaded from environment")
+	}
+
+	// Load the forbidden networks
+	var forbiddenNetworks []*net.IPNet
+	for _, cidr := range viper.GetStringSlice("forbidden_networks") {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid forbidden network %q", cidr)
+		}
+		forbiddenNetworks = append(forbiddenNetworks, network)
+	}
+
+	cfg := &Config{
 		HttpPort:            viper.GetInt("http_port"),
 		TcpPort:             viper.GetInt("tcp_port"),
 		AuthKeys:            authKeys,
+		MaxClockSkew:        viper.GetDuration("max_clock_skew"),
 		AllowedProxyTargets: allowedProxyTargets,
+		KeyScopes:           keyScopes,
+		ClientScopes:        clientScopes,
 		DNSServers:          viper.GetStringSlice("dns_servers"),
+		ForbiddenNetworks:   forbiddenNetworks,
 		HealthPath:          viper.GetString("health_path"),
-	}, nil
+		DrainTimeout:        viper.GetDuration("drain_timeout"),
+		MetricsPath:         viper.GetString("metrics_path"),
+		TLSCertFile:         viper.GetString("tls_cert_file"),
+		TLSKeyFile:          viper.GetString("tls_key_file"),
+		TLSClientCAFile:     viper.GetString("tls_client_ca_file"),
+		TLSAllowedClients:   viper.GetStringSlice("tls_allowed_clients"),
+		AuditLog:            viper.GetString("audit_log"),
+		WSFlushDelay:        viper.GetDuration("ws_flush_delay"),
+		WSMaxFrameSize:      viper.GetInt("ws_max_frame_size"),
+		WSCompression:       viper.GetBool("ws_compression"),
+		WSCompressionLevel:  viper.GetInt("ws_compression_level"),
+	}
+	if cfg.WSFlushDelay < 0 || cfg.WSMaxFrameSize < 0 {
+		return nil, errors.New("websocket flush delay and max frame size can't be negative")
+	}
+	if cfg.WSCompressionLevel < flate.HuffmanOnly || cfg.WSCompressionLevel > flate.BestCompression {
+		return nil, errors.Newf("invalid websocket compression level %d, expected %d to %d", cfg.WSCompressionLevel, flate.HuffmanOnly, flate.BestCompression)
+	}
+
+	// Check the TLS certificate can be loaded now, rather than on the first connection
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, errors.New("both a tls cert file and key file must be provided to enable tls")
+	}
+	if cfg.TLSClientCAFile != "" && !cfg.TLSEnabled() {
+		return nil, errors.New("tls must be enabled to authenticate clients by certificate")
+	}
+	if _, err := cfg.NewTLSConfig(); err != nil {
+		return nil, errors.Wrap(err, "unable to load tls config")
+	}
+
+	log.Info().
+		Int("num_allowed_proxy_targets", len(allowedProxyTargets)).
+		Int("num_auth_keys", len(authKeys)).
+		Int("num_scoped_auth_keys", len(keyScopes)).
+		Int("num_scoped_clients", len(clientScopes)).
+		Bool("tls", cfg.TLSEnabled()).
+		Msg("loaded emissary proxy config")
+
+	return cfg, nil
 }
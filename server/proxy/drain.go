@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Drainer tracks the client connections being served, so that when the server shuts down it can stop accepting
+// new connections and wait for the existing ones to finish.
+type Drainer struct {
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	draining chan struct{} // closed once draining starts
+	idle     chan struct{} // closed once draining and no connections are left
+}
+
+func NewDrainer() *Drainer {
+	return &Drainer{
+		conns:    make(map[net.Conn]struct{}),
+		draining: make(chan struct{}),
+		idle:     make(chan struct{}),
+	}
+}
+
+// Track starts tracking a connection, returning false if the server is draining and the connection should be
+// rejected. Tracked connections must be passed to Untrack once they're closed.
+func (d *Drainer) Track(conn net.Conn) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.isDraining() {
+		return false
+	}
+	d.conns[conn] = struct{}{}
+	return true
+}
+
+// Untrack stops tracking a connection
+func (d *Drainer) Untrack(conn net.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.conns, conn)
+	d.checkIdle()
+}
+
+// Draining returns a channel which is closed once the server has started draining
+func (d *Drainer) Draining() <-chan struct{} {
+	return d.draining
+}
+
+// IsDraining reports if the server has started draining
+func (d *Drainer) IsDraining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.isDraining()
+}
+
+// Drain stops new connections from being accepted and waits for the existing ones to close. If they haven't all
+// closed by the time the context is done, the remaining connections are force closed.
+//
+// It returns the number of connections which were force closed.
+func (d *Drainer) Drain(ctx context.Context) int {
+	d.mu.Lock()
+	if !d.isDraining() {
+		close(d.draining)
+	}
+	d.checkIdle()
+	log.Info().Int("connections", len(d.conns)).Msg("draining connections")
+	d.mu.Unlock()
+
+	select {
+	case <-d.idle:
+		return 0
+	case <-ctx.Done():
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	cut := 0
+	for conn := range d.conns {
+		_ = conn.Close()
+		cut++
+	}
+	return cut
+}
+
+func (d *Drainer) isDraining() bool {
+	select {
+	case <-d.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkIdle closes the idle channel once draining and there are no connections left; d.mu must be held
+func (d *Drainer) checkIdle() {
+	if !d.isDraining() || len(d.conns) > 0 {
+		return
+	}
+
+	select {
+	case <-d.idle:
+	default:
+		close(d.idle)
+	}
+}
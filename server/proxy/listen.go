@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/armon/go-socks5"
+	"github.com/cockroachdb/errors"
+	"github.com/hashicorp/yamux"
+	"github.com/rs/zerolog/log"
+	"go.encore.dev/emissary/internal/emissaryproto"
+)
+
+// serveListen listens on the address a client asked for, once it has been allowed, and forwards each connection
+// accepted there back to the client over a new stream within its session.
+//
+// The server stops listening once the client closes the listen stream, or the server starts draining, and the
+// tunnel finishes once all the connections it accepted have closed.
+func (cfg *Config) serveListen(stream net.Conn, listenerID uint32, session *yamux.Session, t *tunnel, drainer *Drainer) error {
+	// The tunnel stays open until the connections it forwarded have closed, even once we've stopped listening
+	var forwarded sync.WaitGroup
+	defer forwarded.Wait()
+
+	// Closing the stream tells the client why it was rejected, if it was, or that we've stopped listening
+	conn := &tunnelConn{Conn: stream, tunnel: t}
+	defer func() { _ = conn.Close() }()
+
+	host, port, err := emissaryproto.ReadListen(conn)
+	if err != nil {
+		return errors.Wrap(err, "unable to read listen request")
+	}
+	t.mu.Lock()
+	t.event.Listen = true
+	t.mu.Unlock()
+
+	// Resolve the address, so the rules can check the IP we're about to listen on
+	ctx := context.Background()
+	dest := &socks5.AddrSpec{IP: net.ParseIP(host), Port: port}
+	if host == "" {
+		dest.IP = net.IPv4zero
+	} else if dest.IP == nil {
+		dest.FQDN = host
+		ctx, dest.IP, err = cfg.resolver(t).Resolve(ctx, host)
+		if err != nil {
+			return rejectListen(conn, errors.Wrapf(err, "unable to resolve %s", host))
+		}
+	}
+
+	req := &socks5.Request{
+		Command:    socks5.BindCommand,
+		DestAddr:   dest,
+		RemoteAddr: &socks5.AddrSpec{},
+	}
+	if client, ok := stream.RemoteAddr().(*net.TCPAddr); ok {
+		req.RemoteAddr = &socks5.AddrSpec{IP: client.IP, Port: client.Port}
+	}
+	ctx, allowed := scopedRules{cfg: cfg, principal: t.principal, tunnel: t}.Allow(ctx, req)
+	if !allowed {
+		return rejectListen(conn, errors.Newf("listen on %s blocked by rules", dest))
+	}
+
+	listener, err := t.listen(ctx, net.JoinHostPort(dest.IP.String(), strconv.Itoa(port)))
+	if err != nil {
+		return rejectListen(conn, err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	if err := emissaryproto.WriteListenResult(conn, emissaryproto.ListenSuccess, listener.Addr().String()); err != nil {
+		return err //nolint:wrapcheck
+	}
+	log.Info().Str("addr", listener.Addr().String()).Msg("listening for client")
+
+	// The client sends nothing more on the listen stream, so it only returns once the client closes it
+	stopped := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		close(stopped)
+	}()
+	go func() {
+		select {
+		case <-stopped:
+		case <-drainer.Draining():
+		}
+		_ = listener.Close()
+	}()
+
+	rule := ruleFromContext(ctx)
+	for {
+		accepted, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "unable to accept connection")
+		}
+
+		forwarded.Add(1)
+		go func() {
+			defer forwarded.Done()
+			cfg.forwardAccepted(session, listenerID, newMeteredConn(accepted, rule), t)
+		}()
+	}
+}
+
+// forwardAccepted opens a stream back to the client for a connection accepted on its listener, and relays data
+// between them until both sides have closed
+func (cfg *Config) forwardAccepted(session *yamux.Session, listenerID uint32, accepted *meteredConn, t *tunnel) {
+	defer t.accepted(accepted)
+
+	l := log.With().Uint32("listener", listenerID).Str("from", accepted.RemoteAddr().String()).Logger()
+	stream, err := session.OpenStream()
+	if err != nil {
+		l.Err(err).Msg("unable to open stream to forward accepted connection")
+		_ = accepted.Close()
+		return
+	}
+
+	if err := emissaryproto.WriteForwardedConn(stream, listenerID, accepted.RemoteAddr().String()); err != nil {
+		l.Err(err).Msg("unable to forward accepted connection")
+		_ = accepted.Close()
+		_ = stream.Close()
+		return
+	}
+	l.Debug().Msg("forwarding accepted connection to client")
+
+	relay(&sessionStream{stream}, accepted)
+}
+
+// relay copies data in both directions between two connections, half closing each as the other finishes sending,
+// until both directions are done
+func relay(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	halfRelay := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		if closer, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = closer.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+	go halfRelay(a, b)
+	go halfRelay(b, a)
+	wg.Wait()
+
+	_ = a.Close()
+	_ = b.Close()
+}
+
+// rejectListen tells the client its listen request was rejected, returning the reason
+func rejectListen(conn net.Conn, reason error) error {
+	if err := emissaryproto.WriteListenResult(conn, emissaryproto.ListenFailure, ""); err != nil {
+		return errors.CombineErrors(reason, err)
+	}
+	return reason
+}
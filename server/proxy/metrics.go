@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/armon/go-socks5"
+	"github.com/cockroachdb/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.encore.dev/emissary/internal/emissaryproto"
+)
+
+// The transports a client can connect to the server over, used to label metrics
+const (
+	TransportHTTP = "http"
+	TransportTCP  = "tcp"
+)
+
+// The outcomes of a client handshake, used to label the handshakes metric
+const (
+	handshakeSuccess          = "success"
+	handshakeBadVersion       = "bad_version"
+	handshakeBadHMAC          = "bad_hmac"
+	handshakeUnknownKeyID     = "unknown_key_id"
+	handshakeClockSkew        = "clock_skew"
+	handshakeReplayed         = "replayed"
+	handshakeRuleDenied       = "rule_denied"
+	handshakeForbiddenNetwork = "forbidden_network"
+)
+
+var (
+	activeSessions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "emissary",
+		Name:      "active_sessions",
+		Help:      "The number of client connections currently being served, by transport.",
+	}, []string{"transport"})
+
+	handshakes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "emissary",
+		Name:      "handshakes_total",
+		Help:      "The number of client handshakes and proxy requests, by outcome.",
+	}, []string{"outcome"})
+
+	targetBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "emissary",
+		Name:      "target_bytes_total",
+		Help:      "The number of bytes proxied to and from the targets each allow rule matched; in is received from the target, out is sent to it.",
+	}, []string{"rule", "direction"})
+
+	dialDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "emissary",
+		Name:      "target_dial_duration_seconds",
+		Help:      "How long it took to connect to the targets each allow rule matched, by result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"rule", "result"})
+
+	dnsFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "emissary",
+		Name:      "dns_resolution_failures_total",
+		Help:      "The number of proxy targets which could not be resolved.",
+	})
+)
+
+// unmatchedRule labels the metrics of targets dialed without an allow rule matching them
+const unmatchedRule = "unmatched"
+
+type ruleContextKey struct{}
+
+// requestTarget returns the target a request is for, as the client asked for it
+func requestTarget(req *socks5.Request) string {
+	host := req.DestAddr.FQDN
+	if host == "" {
+		host = req.DestAddr.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(req.DestAddr.Port))
+}
+
+// withRule returns a context recording the allow rule which matched a request
+func withRule(ctx context.Context, rule AllowedHost) context.Context {
+	return context.WithValue(ctx, ruleContextKey{}, rule.String())
+}
+
+// ruleFromContext returns the allow rule which matched a request, which labels its metrics. Labelling by rule, rather
+// than by target, keeps the number of labels bounded by the config when rules match many targets.
+func ruleFromContext(ctx context.Context) string {
+	if rule, ok := ctx.Value(ruleContextKey{}).(string); ok {
+		return rule
+	}
+	return unmatchedRule
+}
+
+// meteredConn counts the bytes sent to and received from a target
+type meteredConn struct {
+	bytesIn  int64 // accessed atomically, so kept first for alignment
+	bytesOut int64
+	net.Conn
+	in  prometheus.Counter
+	out prometheus.Counter
+}
+
+func newMeteredConn(conn net.Conn, rule string) *meteredConn {
+	return &meteredConn{
+		Conn: conn,
+		in:   targetBytes.WithLabelValues(rule, "in"),
+		out:  targetBytes.WithLabelValues(rule, "out"),
+	}
+}
+
+func (m *meteredConn) Read(p []byte) (int, error) {
+	n, err := m.Conn.Read(p)
+	atomic.AddInt64(&m.bytesIn, int64(n))
+	m.in.Add(float64(n))
+	return n, err //nolint:wrapcheck
+}
+
+func (m *meteredConn) Write(p []byte) (int, error) {
+	n, err := m.Conn.Write(p)
+	atomic.AddInt64(&m.bytesOut, int64(n))
+	m.out.Add(float64(n))
+	return n, err //nolint:wrapcheck
+}
+
+// bytes returns the number of bytes received from and sent to the target so far
+func (m *meteredConn) bytes() (in, out int64) {
+	return atomic.LoadInt64(&m.bytesIn), atomic.LoadInt64(&m.bytesOut)
+}
+
+// CloseWrite half closes the underlying connection if it supports it, so the SOCKS5 proxy can still do so.
+func (m *meteredConn) CloseWrite() error {
+	if closer, ok := m.Conn.(interface{ CloseWrite() error }); ok {
+		return errors.Wrap(closer.CloseWrite(), "unable to close write")
+	}
+	return nil
+}
+
+// meteredResolver counts the names which could not be resolved
+type meteredResolver struct {
+	socks5.NameResolver
+	tunnel *tunnel
+}
+
+func (m meteredResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ip, err := m.NameResolver.Resolve(ctx, name)
+	if err != nil {
+		dnsFailures.Inc()
+		m.tunnel.rejected(emissaryproto.HandshakeError_TARGET_UNREACHABLE, "unable to resolve target")
+	}
+	return ctx, ip, err //nolint:wrapcheck
+}
@@ -5,59 +5,163 @@ import (
 	"crypto/rand"
 	golog "log"
 	"net"
+	"syscall"
 	"time"
 
 	"github.com/armon/go-socks5"
 	"github.com/cockroachdb/errors"
-	"github.com/golang/protobuf/proto"
 	"github.com/rs/zerolog/log"
 	"go.encore.dev/emissary/internal/emissaryproto"
 )
 
-// ServeConn takes a connection and runs the emissary proxy on it
-func (cfg *Config) ServeConn(conn net.Conn) error {
+// ErrDraining is returned when a connection is rejected because the server is draining
+var ErrDraining = errors.New("server is draining")
+
+// ServeConn takes a connection which was made over the given transport and runs the emissary proxy on it.
+//
+// The connect message is sent framed if framed is true, which it must be unless the transport preserves message
+// boundaries and the client has not asked for it to be framed.
+//
+// The connection is tracked by the drainer, so it can be waited upon or closed when the server shuts down.
+func (cfg *Config) ServeConn(conn net.Conn, transport string, framed bool, drainer *Drainer) error {
+	if !drainer.Track(conn) {
+		return ErrDraining
+	}
+	defer drainer.Untrack(conn)
+
+	sessions := activeSessions.WithLabelValues(transport)
+	sessions.Inc()
+	defer sessions.Dec()
+
 	nonce := make([]byte, emissaryproto.NonceSize)
 	if _, err := rand.Read(nonce); err != nil {
 		return errors.Wrap(err, "unable to create nonce")
 	}
 
-	// Send the emissary server version number
+	// If the client presented a certificate, find out who it is
+	p := &principal{clientIdentity: cfg.clientIdentity(conn)}
+
+	// Send the emissary server version number, and the range of protocol versions we support. Clients which don't
+	// negotiate will speak the legacy version, which we still support.
 	connectMsg := &emissaryproto.ServerConnect{
-		ServerSoftware:  emissaryproto.EmissaryServer,
-		ServerVersion:   emissaryproto.EmissaryServerVersion,
-		ProtocolVersion: emissaryproto.ProtocolVersion,
-		ConnectionNonce: nonce,
+		ServerSoftware:     emissaryproto.EmissaryServer,
+		ServerVersion:      emissaryproto.EmissaryServerVersion,
+		ProtocolVersion:    emissaryproto.LegacyProtocolVersion,
+		ConnectionNonce:    nonce,
+		ServerTime:         time.Now().UnixMilli(),
+		MinProtocolVersion: emissaryproto.MinProtocolVersion,
+		MaxProtocolVersion: emissaryproto.ProtocolVersion,
+		Features: []string{
+			emissaryproto.FeatureSessions, emissaryproto.FeatureHandshakeErrors,
+			emissaryproto.FeatureUDP, emissaryproto.FeatureListen,
+		},
 	}
-	bytes, err := proto.Marshal(connectMsg)
-	if err != nil {
-		return errors.Wrap(err, "unable to marshal connect message")
+	if err := emissaryproto.WriteConnectMessage(conn, connectMsg, framed); err != nil {
+		return err //nolint:wrapcheck
 	}
-	_, err = conn.Write(bytes)
+
+	// Work out which protocol the client has chosen to speak from the first byte it sends
+	bufConn := newBufferedConn(conn)
+	first, err := bufConn.Peek(1)
 	if err != nil {
-		return errors.Wrap(err, "unable to send connect message")
+		return errors.Wrap(err, "unable to read from client")
 	}
 
-	var resolver socks5.NameResolver = socks5.DNSResolver{}
-	if len(cfg.DNSServers) > 0 {
-		resolver = customDNSResolver{ServerIPs: cfg.DNSServers, Fallback: socks5.DNSResolver{}}
+	switch first[0] {
+	case emissaryproto.SOCKS5Version:
+		// Pass the connection over to the SOCKS5 server
+		log.Debug().Str("remote", conn.RemoteAddr().String()).Bool("compressed", compressed(conn)).Msg("started legacy tunnel")
+		t := cfg.newTunnel(p, transport, conn.RemoteAddr())
+		server, err := cfg.newSOCKS5Server(newAuthenticator(cfg, nonce, t), t)
+		if err != nil {
+			return err
+		}
+		err = server.ServeConn(&tunnelConn{Conn: bufConn, tunnel: t})
+		t.finish(err)
+		if err != nil {
+			return errors.Wrap(err, "error while running socks 5 proxy")
+		}
+		return nil
+
+	case emissaryproto.SessionAuthVersion:
+		return cfg.serveSession(bufConn, nonce, p, transport, drainer)
+
+	default:
+		handshakes.WithLabelValues(handshakeBadVersion).Inc()
+		if err := emissaryproto.WriteHandshakeError(conn, emissaryproto.HandshakeError_PROTOCOL_VERSION, "unknown protocol requested"); err != nil {
+			log.Debug().Err(err).Msg("unable to tell client its protocol is not supported")
+		}
+		return errors.Newf("unknown protocol requested by client: %d", first[0])
 	}
+}
 
+// newSOCKS5Server creates a SOCKS5 server for a single tunnel, which will use the given authentication methods,
+// and the rules for the principal the tunnel is authenticated as
+func (cfg *Config) newSOCKS5Server(authMethods []socks5.Authenticator, t *tunnel) (*socks5.Server, error) {
 	// Set up our SOCKS5 server
 	server, err := socks5.New(&socks5.Config{
-		AuthMethods: newAuthenticator(cfg, nonce),
-		Rules:       cfg.AllowedProxyTargets,
+		AuthMethods: authMethods,
+		Rules:       scopedRules{cfg: cfg, principal: t.principal, tunnel: t},
 		Logger:      golog.New(log.Logger, "", golog.Lshortfile),
-		Resolver:    resolver,
+		Resolver:    cfg.resolver(t),
+		Dial:        t.dial,
 	})
 	if err != nil {
-		return errors.Wrap(err, "unable to setup socks5 proxy server")
+		return nil, errors.Wrap(err, "unable to setup socks5 proxy server")
 	}
 
-	// Pass the connection over to the SOCKS5 server
-	if err := server.ServeConn(conn); err != nil {
-		return errors.Wrap(err, "error while running socks 5 proxy")
+	return server, nil
+}
+
+// resolver returns the resolver to look up the targets of a tunnel with
+func (cfg *Config) resolver(t *tunnel) socks5.NameResolver {
+	var resolver socks5.NameResolver = socks5.DNSResolver{}
+	if len(cfg.DNSServers) > 0 {
+		resolver = customDNSResolver{ServerIPs: cfg.DNSServers, Fallback: socks5.DNSResolver{}}
+	}
+	return meteredResolver{NameResolver: resolver, tunnel: t}
+}
+
+// dialTarget connects to the proxy target, checking the IP actually being connected to is not in a forbidden network
+func (cfg *Config) dialTarget(ctx context.Context, network, addr string) (*meteredConn, error) {
+	dialer := &net.Dialer{
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return errors.Wrap(err, "unable to parse target address")
+			}
+
+			if forbidden := cfg.forbiddenNetwork(net.ParseIP(host)); forbidden != nil {
+				log.Warn().Str("to_ip", host).Str("forbidden_network", forbidden.String()).Msg("refusing to dial target in forbidden network")
+				return errors.Newf("target %s is in forbidden network %s", host, forbidden)
+			}
+			return nil
+		},
 	}
 
+	rule := ruleFromContext(ctx)
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		dialDuration.WithLabelValues(rule, "error").Observe(time.Since(start).Seconds())
+		return nil, errors.Wrap(err, "unable to dial target")
+	}
+	dialDuration.WithLabelValues(rule, "success").Observe(time.Since(start).Seconds())
+
+	return newMeteredConn(conn, rule), nil
+}
+
+// forbiddenNetwork returns the forbidden network which contains the IP, or nil if the IP is not forbidden
+func (cfg *Config) forbiddenNetwork(ip net.IP) *net.IPNet {
+	if len(ip) == 0 {
+		return nil
+	}
+
+	for _, network := range cfg.ForbiddenNetworks {
+		if network.Contains(ip) {
+			return network
+		}
+	}
 	return nil
 }
 
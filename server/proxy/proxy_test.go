@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"context"
+	"net"
 	"testing"
 
 	"github.com/armon/go-socks5"
@@ -43,3 +44,27 @@ func TestCustomDNSServerFallback(t *testing.T) {
 		t.Fatalf("got zero ip: %s", ip)
 	}
 }
+
+func TestDialTargetForbiddenNetwork(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	cfg := &Config{ForbiddenNetworks: []*net.IPNet{loopback}}
+	if conn, err := cfg.dialTarget(context.Background(), "tcp", listener.Addr().String()); err == nil {
+		_ = conn.Close()
+		t.Fatalf("expected dial to forbidden network to fail")
+	}
+
+	cfg = &Config{}
+	conn, err := cfg.dialTarget(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to dial allowed target: %v", err)
+	}
+	_ = conn.Close()
+}
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/cockroachdb/errors"
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// LiveConfig holds the Config currently in use by the server, allowing it to be reloaded while the server is running.
+//
+// Connections take the current config when they are accepted, so a reload only applies to new connections;
+// existing tunnels carry on with the config they were started with.
+type LiveConfig struct {
+	current  atomic.Value // *Config
+	reloadMu sync.Mutex
+}
+
+// NewLiveConfig creates a LiveConfig which starts out using the given config
+func NewLiveConfig(cfg *Config) *LiveConfig {
+	l := &LiveConfig{}
+	l.current.Store(cfg)
+	return l
+}
+
+// Load returns the config which new connections should use
+func (l *LiveConfig) Load() *Config {
+	return l.current.Load().(*Config) //nolint:forcetypeassert
+}
+
+// Reload re-reads the config file and environment, and swaps in the new config.
+//
+// If the new config is invalid, an error is returned and the current config is kept.
+func (l *LiveConfig) Reload() error {
+	l.reloadMu.Lock()
+	defer l.reloadMu.Unlock()
+
+	next, err := readConfig()
+	if err != nil {
+		return errors.Wrap(err, "unable to read config")
+	}
+
+	current := l.Load()
+	keepListenerSettings(current, next)
+	next.replays = current.replayCache()
+	logConfigChanges(current, next)
+
+	l.current.Store(next)
+	return nil
+}
+
+// WatchConfig reloads the config whenever the config file changes or the process receives a SIGHUP,
+// until the context is cancelled.
+func (l *LiveConfig) WatchConfig(ctx context.Context) {
+	reload := func(reason string) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Info().Str("reason", reason).Msg("reloading emissary proxy config")
+		if err := l.Reload(); err != nil {
+			log.Err(err).Msg("unable to reload emissary proxy config, keeping the current config")
+		}
+	}
+
+	// Viper can only watch a config file which exists, and needs an absolute path to find the directory to watch
+	if file := viper.ConfigFileUsed(); file != "" {
+		if path, err := filepath.Abs(file); err == nil {
+			if _, err := os.Stat(path); err == nil {
+				viper.SetConfigFile(path)
+				viper.OnConfigChange(func(_ fsnotify.Event) { reload("config file changed") })
+				viper.WatchConfig()
+				log.Info().Str("file", path).Msg("watching config file for changes")
+			}
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				reload("SIGHUP")
+			}
+		}
+	}()
+}
+
+// keepListenerSettings copies the settings which are only read when the servers start listening from
+// the current config, as changing them requires a restart.
+func keepListenerSettings(current, next *Config) {
+	warn := func(setting string, changed bool) {
+		if changed {
+			log.Warn().Str("setting", setting).Msg("config setting changed, but requires a restart to take effect")
+		}
+	}
+
+	warn("http_port", current.HttpPort != next.HttpPort)
+	warn("tcp_port", current.TcpPort != next.TcpPort)
+	warn("health_path", current.HealthPath != next.HealthPath)
+	warn("metrics_path", current.MetricsPath != next.MetricsPath)
+	warn("tls_cert_file", current.TLSCertFile != next.TLSCertFile)
+	warn("tls_key_file", current.TLSKeyFile != next.TLSKeyFile)
+	warn("tls_client_ca_file", current.TLSClientCAFile != next.TLSClientCAFile)
+	warn("audit_log", current.AuditLog != next.AuditLog)
+
+	next.HttpPort = current.HttpPort
+	next.TcpPort = current.TcpPort
+	next.HealthPath = current.HealthPath
+	next.MetricsPath = current.MetricsPath
+	next.TLSCertFile = current.TLSCertFile
+	next.TLSKeyFile = current.TLSKeyFile
+	next.TLSCertificate = current.TLSCertificate
+	next.TLSClientCAFile = current.TLSClientCAFile
+	next.TLSClientCAs = current.TLSClientCAs
+	next.AuditLog = current.AuditLog
+	next.AuditSink = current.AuditSink
+}
+
+// logConfigChanges logs what has changed between the current and next config.
+//
+// Auth keys are only ever logged by ID, so secrets don't end up in the logs.
+func logConfigChanges(current, next *Config) {
+	changed := false
+
+	var added, removed, rotated []uint32
+	currentKeys := make(map[uint32][]byte, len(current.AuthKeys))
+	for _, key := range current.AuthKeys {
+		currentKeys[key.KeyID] = key.Data
+	}
+	nextKeys := make(map[uint32]bool, len(next.AuthKeys))
+	for _, key := range next.AuthKeys {
+		nextKeys[key.KeyID] = true
+		if data, found := currentKeys[key.KeyID]; !found {
+			added = append(added, key.KeyID)
+		} else if !bytes.Equal(data, key.Data) {
+			rotated = append(rotated, key.KeyID)
+		}
+	}
+	for _, key := range current.AuthKeys {
+		if !nextKeys[key.KeyID] {
+			removed = append(removed, key.KeyID)
+		}
+	}
+	if len(added) > 0 || len(removed) > 0 || len(rotated) > 0 {
+		changed = true
+		log.Info().Uints32("added", added).Uints32("removed", removed).Uints32("rotated", rotated).
+			Msg("auth keys changed")
+	}
+
+	if !reflect.DeepEqual(current.AllowedProxyTargets, next.AllowedProxyTargets) {
+		changed = true
+		log.Info().Interface("old", current.AllowedProxyTargets).Interface("new", next.AllowedProxyTargets).
+			Msg("allowed proxy targets changed")
+	}
+
+	var scopesChanged []uint32
+	for keyID, targets := range next.KeyScopes {
+		if !reflect.DeepEqual(current.KeyScopes[keyID], targets) {
+			scopesChanged = append(scopesChanged, keyID)
+		}
+	}
+	for keyID := range current.KeyScopes {
+		if _, found := next.KeyScopes[keyID]; !found {
+			scopesChanged = append(scopesChanged, keyID)
+		}
+	}
+	if len(scopesChanged) > 0 {
+		changed = true
+		log.Info().Uints32("key_ids", scopesChanged).Msg("key scopes changed")
+	}
+
+	var clientScopesChanged []string
+	for identity, targets := range next.ClientScopes {
+		if !reflect.DeepEqual(current.ClientScopes[identity], targets) {
+			clientScopesChanged = append(clientScopesChanged, identity)
+		}
+	}
+	for identity := range current.ClientScopes {
+		if _, found := next.ClientScopes[identity]; !found {
+			clientScopesChanged = append(clientScopesChanged, identity)
+		}
+	}
+	if len(clientScopesChanged) > 0 {
+		changed = true
+		sort.Strings(clientScopesChanged)
+		log.Info().Strs("client_identities", clientScopesChanged).Msg("client scopes changed")
+	}
+
+	logStrings := func(setting string, old, new []string) {
+		if !reflect.DeepEqual(old, new) {
+			changed = true
+			log.Info().Strs("old", old).Strs("new", new).Msgf("%s changed", setting)
+		}
+	}
+	logStrings("dns servers", current.DNSServers, next.DNSServers)
+	logStrings("forbidden networks", networkStrings(current.ForbiddenNetworks), networkStrings(next.ForbiddenNetworks))
+	logStrings("tls allowed clients", current.TLSAllowedClients, next.TLSAllowedClients)
+
+	if !changed {
+		log.Info().Msg("emissary proxy config reloaded with no changes")
+	}
+}
+
+func networkStrings(networks []*net.IPNet) []string {
+	strs := make([]string, 0, len(networks))
+	for _, network := range networks {
+		strs = append(strs, network.String())
+	}
+	return strs
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestLiveConfigReload(t *testing.T) {
+	t.Setenv("EMISSARY_AUTH_KEYS", `[{"kid": 1, "data": "c2VjcmV0"}]`)
+	t.Setenv("EMISSARY_ALLOWED_PROXY_TARGETS", `[{"host": "db.internal", "port": 5432}]`)
+
+	cfg, err := LoadConfig(context.Background())
+	if err != nil {
+		t.Fatalf("unable to load config: %v", err)
+	}
+	live := NewLiveConfig(cfg)
+
+	// Change the targets, and a setting which requires a restart
+	t.Setenv("EMISSARY_ALLOWED_PROXY_TARGETS", `[{"host": "redis.internal", "port": 6379}]`)
+	t.Setenv("EMISSARY_HTTP_PORT", "9090")
+	if err := live.Reload(); err != nil {
+		t.Fatalf("unable to reload config: %v", err)
+	}
+
+	reloaded := live.Load()
+	if want := (AllowedProxyTargets{{Host: "redis.internal", Port: 6379}}); !reflect.DeepEqual(reloaded.AllowedProxyTargets, want) {
+		t.Errorf("expected reloaded targets %v, got %v", want, reloaded.AllowedProxyTargets)
+	}
+	if reloaded.HttpPort != cfg.HttpPort {
+		t.Errorf("expected http port to stay %d until restart, got %d", cfg.HttpPort, reloaded.HttpPort)
+	}
+	if want := (AllowedProxyTargets{{Host: "db.internal", Port: 5432}}); !reflect.DeepEqual(cfg.AllowedProxyTargets, want) {
+		t.Errorf("expected original config to be unchanged, got %v", cfg.AllowedProxyTargets)
+	}
+
+	// An invalid config should be rejected, keeping the current one
+	t.Setenv("EMISSARY_AUTH_KEYS", "")
+	if err := live.Reload(); err == nil {
+		t.Errorf("expected reloading an invalid config to fail")
+	}
+	if live.Load() != reloaded {
+		t.Errorf("expected the current config to be kept after a failed reload")
+	}
+}
+
+func TestLiveConfigWatchesConfigFile(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Cleanup(viper.Reset) // forget the file's settings, and where it was found, once it's gone
+	dir := filepath.Join(home, ".emissary")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatalf("unable to create config dir: %v", err)
+	}
+	file := filepath.Join(dir, "config.yaml")
+	writeConfig := func(target string) {
+		config := "auth_keys: '[{\"kid\": 1, \"data\": \"c2VjcmV0\"}]'\nallowed_proxy_targets: '[" + target + "]'\n"
+		if err := os.WriteFile(file, []byte(config), 0o600); err != nil {
+			t.Fatalf("unable to write config file: %v", err)
+		}
+	}
+	writeConfig(`{"host": "db.internal", "port": 5432}`)
+
+	cfg, err := LoadConfig(context.Background())
+	if err != nil {
+		t.Fatalf("unable to load config: %v", err)
+	}
+	if want := (AllowedProxyTargets{{Host: "db.internal", Port: 5432}}); !reflect.DeepEqual(cfg.AllowedProxyTargets, want) {
+		t.Fatalf("expected targets %v from %s, got %v", want, file, cfg.AllowedProxyTargets)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	live := NewLiveConfig(cfg)
+	live.WatchConfig(ctx)
+
+	// Changing the file should reload the config without being told to
+	writeConfig(`{"host": "redis.internal", "port": 6379}`)
+	want := AllowedProxyTargets{{Host: "redis.internal", Port: 6379}}
+	for deadline := time.Now().Add(5 * time.Second); !reflect.DeepEqual(live.Load().AllowedProxyTargets, want); {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected targets %v after changing %s, got %v", want, file, live.Load().AllowedProxyTargets)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
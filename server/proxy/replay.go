@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// MaxReplayCacheEntries bounds how many used signatures we remember. Once full, the oldest signatures are forgotten
+// early, so under extreme load it's possible for a signature to be reused within its validity window.
+const MaxReplayCacheEntries = 100000
+
+// replayCache remembers the signatures clients have authenticated with until they expire, so they can't be reused.
+//
+// Signatures are only valid while their date is within the allowed clock skew, so they only need to be remembered
+// until then. As signatures are mostly added in date order, entries are kept in insertion order and expired from
+// the front of the list.
+type replayCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[replayKey]*list.Element
+	order      *list.List // of *replayEntry, oldest first
+}
+
+type replayKey struct {
+	keyID     uint32
+	date      string
+	signature string
+}
+
+type replayEntry struct {
+	key     replayKey
+	expires time.Time
+}
+
+func newReplayCache(maxEntries int) *replayCache {
+	return &replayCache{
+		maxEntries: maxEntries,
+		entries:    make(map[replayKey]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// seen records the signature as used until it expires, returning true if it had already been used.
+func (c *replayCache) seen(keyID uint32, date, signature string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	key := replayKey{keyID: keyID, date: date, signature: signature}
+	if elem, found := c.entries[key]; found {
+		if now.Before(elem.Value.(*replayEntry).expires) { //nolint:forcetypeassert
+			return true
+		}
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+
+	// Remove anything which has expired, and make room for the new entry
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		entry := front.Value.(*replayEntry) //nolint:forcetypeassert
+		if now.Before(entry.expires) && c.order.Len() < c.maxEntries {
+			break
+		}
+		c.order.Remove(front)
+		delete(c.entries, entry.key)
+	}
+
+	c.entries[key] = c.order.PushBack(&replayEntry{key: key, expires: expires})
+	return false
+}
+
+// len returns the number of signatures being remembered
+func (c *replayCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"go.encore.dev/emissary/internal/auth"
+	"go.encore.dev/emissary/internal/emissaryproto"
+)
+
+func TestReplayCache(t *testing.T) {
+	t.Parallel()
+
+	cache := newReplayCache(2)
+	expires := time.Now().Add(time.Minute)
+
+	if cache.seen(1, "date", "sig-a", expires) {
+		t.Errorf("expected the first use of a signature to not be seen")
+	}
+	if !cache.seen(1, "date", "sig-a", expires) {
+		t.Errorf("expected the second use of a signature to be seen")
+	}
+	if cache.seen(2, "date", "sig-a", expires) {
+		t.Errorf("expected the same signature from another key to not be seen")
+	}
+
+	// The cache is full, so the oldest signature is forgotten to make room
+	if cache.seen(1, "date", "sig-b", expires) {
+		t.Errorf("expected a new signature to not be seen")
+	}
+	if got := cache.len(); got != 2 {
+		t.Errorf("expected the cache to be bounded to 2 entries, got %d", got)
+	}
+
+	// Expired signatures are forgotten
+	cache = newReplayCache(10)
+	cache.seen(1, "date", "sig-a", time.Now().Add(-time.Second))
+	if cache.seen(1, "date", "sig-a", expires) {
+		t.Errorf("expected an expired signature to not be seen")
+	}
+	if got := cache.len(); got != 1 {
+		t.Errorf("expected only the unexpired entry to be kept, got %d", got)
+	}
+}
+
+func TestAuthenticatorRejectsReplays(t *testing.T) {
+	t.Parallel()
+
+	key := auth.Key{KeyID: 1, Data: []byte("secret")}
+	cfg := &Config{AuthKeys: auth.Keys{key}}
+	nonce := []byte("fixed nonce")
+
+	date, sig, err := auth.SignRequest(key, base64.RawStdEncoding.EncodeToString(nonce))
+	if err != nil {
+		t.Fatalf("unable to sign request: %v", err)
+	}
+
+	a := authenticator{cfg: cfg, nonce: nonce, principal: &principal{}}
+	if status := a.authenticate(date, sig); status != emissaryproto.SessionAuthSuccess {
+		t.Fatalf("expected the first handshake to succeed, got status %d", status)
+	}
+
+	a = authenticator{cfg: cfg, nonce: nonce, principal: &principal{}}
+	if status := a.authenticate(date, sig); status != emissaryproto.SessionAuthReplayed {
+		t.Errorf("expected the replayed handshake to be rejected, got status %d", status)
+	}
+	if a.principal.hasKeyID {
+		t.Errorf("expected the replayed handshake to not authenticate the principal")
+	}
+}
+
+func TestAuthenticatorReportsClockSkew(t *testing.T) {
+	t.Parallel()
+
+	key := auth.Key{KeyID: 1, Data: []byte("secret")}
+	cfg := &Config{AuthKeys: auth.Keys{key}, MaxClockSkew: time.Nanosecond}
+	nonce := []byte("fixed nonce")
+
+	date, sig, err := auth.SignRequest(key, base64.RawStdEncoding.EncodeToString(nonce))
+	if err != nil {
+		t.Fatalf("unable to sign request: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+
+	a := authenticator{cfg: cfg, nonce: nonce, principal: &principal{}}
+	if status := a.authenticate(date, sig); status != emissaryproto.SessionAuthClockSkew {
+		t.Errorf("expected a handshake outside the allowed skew to be rejected for clock skew, got status %d", status)
+	}
+
+	wrongKey := auth.Key{KeyID: 1, Data: []byte("wrong")}
+	date, sig, err = auth.SignRequest(wrongKey, base64.RawStdEncoding.EncodeToString(nonce))
+	if err != nil {
+		t.Fatalf("unable to sign request: %v", err)
+	}
+	if status := a.authenticate(date, sig); status != emissaryproto.SessionAuthFailure {
+		t.Errorf("expected a handshake with the wrong key to fail, got status %d", status)
+	}
+}
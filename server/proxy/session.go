@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"bufio"
+	golog "log"
+	"net"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/cockroachdb/errors"
+	"github.com/hashicorp/yamux"
+	"github.com/rs/zerolog/log"
+	"go.encore.dev/emissary/internal/emissaryproto"
+)
+
+// drainPollInterval is how often a draining session checks if its streams have finished
+const drainPollInterval = 100 * time.Millisecond
+
+// serveSession authenticates a multiplexed session and then runs a SOCKS5 server on every stream the client opens
+func (cfg *Config) serveSession(conn net.Conn, nonce []byte, p *principal, transport string, drainer *Drainer) error {
+	date, signature, err := emissaryproto.ReadSessionAuth(conn)
+	if err != nil {
+		return errors.Wrap(err, "unable to read session auth")
+	}
+
+	status := authenticator{cfg: cfg, nonce: nonce, principal: p}.authenticate(date, signature)
+	if err := emissaryproto.WriteSessionAuthResult(conn, status); err != nil {
+		return errors.Wrap(err, "unable to send session auth result")
+	}
+	if status != emissaryproto.SessionAuthSuccess {
+		err := errors.Newf("session authentication failed with status %d", status)
+		cfg.newTunnel(p, transport, conn.RemoteAddr()).finish(err)
+		return err
+	}
+
+	yamuxConfig := yamux.DefaultConfig()
+	yamuxConfig.LogOutput = nil
+	yamuxConfig.Logger = golog.New(log.Logger, "", golog.Lshortfile)
+	session, err := yamux.Server(conn, yamuxConfig)
+	if err != nil {
+		return errors.Wrap(err, "unable to start session")
+	}
+	defer func() { _ = session.Close() }()
+
+	log.Debug().Str("remote", conn.RemoteAddr().String()).Bool("compressed", compressed(conn)).Msg("started multiplexed session")
+
+	// When the server starts draining, tell the client not to open any more streams, and close the session
+	// once the streams already open have finished
+	go func() {
+		select {
+		case <-session.CloseChan():
+			return
+		case <-drainer.Draining():
+		}
+
+		if err := session.GoAway(); err != nil {
+			log.Err(err).Msg("unable to tell client the session is going away")
+		}
+
+		ticker := time.NewTicker(drainPollInterval)
+		defer ticker.Stop()
+		for session.NumStreams() > 0 {
+			select {
+			case <-session.CloseChan():
+				return
+			case <-ticker.C:
+			}
+		}
+		_ = session.Close()
+	}()
+
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if session.IsClosed() {
+				return nil
+			}
+			return errors.Wrap(err, "unable to accept stream")
+		}
+
+		go cfg.serveStream(session, stream, p, transport, drainer)
+	}
+}
+
+// serveStream runs a SOCKS5 server on a stream within an authenticated session
+func (cfg *Config) serveStream(session *yamux.Session, stream *yamux.Stream, p *principal, transport string, drainer *Drainer) {
+	t := cfg.newTunnel(p, transport, stream.RemoteAddr())
+
+	// Streams tunnel datagrams if they start with a UDP associate request, and listen for connections if they start
+	// with a listen request, otherwise they're SOCKS5
+	conn := newBufferedConn(&sessionStream{stream})
+	first, err := conn.Peek(1)
+	if err != nil {
+		log.Err(err).Uint32("stream", stream.StreamID()).Msg("unable to read from session stream")
+		_ = stream.Close()
+		return
+	}
+	switch first[0] {
+	case emissaryproto.UDPAssociateCommand:
+		err := cfg.serveUDPAssociate(conn, t)
+		t.finish(err)
+		if err != nil {
+			log.Err(err).Uint32("stream", stream.StreamID()).Msg("error while tunnelling udp on session stream")
+		}
+		return
+
+	case emissaryproto.ListenCommand:
+		err := cfg.serveListen(conn, stream.StreamID(), session, t, drainer)
+		t.finish(err)
+		if err != nil {
+			log.Err(err).Uint32("stream", stream.StreamID()).Msg("error while listening on session stream")
+		}
+		return
+	}
+
+	// The session is authenticated as a whole, so the streams within it do not need to authenticate again
+	server, err := cfg.newSOCKS5Server([]socks5.Authenticator{&socks5.NoAuthAuthenticator{}}, t)
+	if err != nil {
+		log.Err(err).Uint32("stream", stream.StreamID()).Msg("unable to create socks 5 proxy for session stream")
+		_ = stream.Close()
+		return
+	}
+
+	err = server.ServeConn(&tunnelConn{Conn: conn, tunnel: t})
+	t.finish(err)
+	if err != nil {
+		log.Err(err).Uint32("stream", stream.StreamID()).Msg("error while running socks 5 proxy on session stream")
+	}
+}
+
+// sessionStream adapts a yamux stream so the SOCKS5 proxy can half close it.
+type sessionStream struct {
+	*yamux.Stream
+}
+
+// CloseWrite closes the stream for writing; yamux streams remain readable until the remote side closes them.
+func (s *sessionStream) CloseWrite() error {
+	return errors.Wrap(s.Stream.Close(), "unable to close stream")
+}
+
+// compressed reports if the transport compresses what it carries, such as a websocket which negotiated
+// permessage-deflate
+func compressed(conn net.Conn) bool {
+	if b, ok := conn.(*bufferedConn); ok {
+		conn = b.Conn
+	}
+	c, ok := conn.(interface{ Compressed() bool })
+	return ok && c.Compressed()
+}
+
+// bufferedConn allows us to peek at the start of a connection before handing it over to the protocol handler
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (b *bufferedConn) Peek(n int) ([]byte, error) {
+	bytes, err := b.r.Peek(n)
+	return bytes, errors.Wrap(err, "unable to peek connection")
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p) //nolint:wrapcheck
+}
+
+// CloseWrite half closes the underlying connection if it supports it.
+func (b *bufferedConn) CloseWrite() error {
+	if closer, ok := b.Conn.(interface{ CloseWrite() error }); ok {
+		return errors.Wrap(closer.CloseWrite(), "unable to close write")
+	}
+	return nil
+}
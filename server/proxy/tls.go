@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// CertificateCheckInterval is how often we check the certificate files on disk for changes
+const CertificateCheckInterval = 10 * time.Second
+
+// TLSEnabled reports whether the servers should terminate TLS themselves
+func (cfg *Config) TLSEnabled() bool {
+	return cfg.TLSCertificate != nil || cfg.TLSCertFile != ""
+}
+
+// NewTLSConfig returns the TLS config the servers should use, or nil if TLS is disabled.
+//
+// If the certificate was loaded from disk, then it will be reloaded whenever the files change.
+func (cfg *Config) NewTLSConfig() (*tls.Config, error) {
+	if !cfg.TLSEnabled() {
+		return nil, nil //nolint:nilnil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	// Verify client certificates if they're presented, but still allow clients to authenticate using a hmac instead
+	clientCAs, err := cfg.clientCAs()
+	if err != nil {
+		return nil, err
+	}
+	if clientCAs != nil {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.ClientCAs = clientCAs
+	}
+
+	if cfg.TLSCertificate != nil {
+		tlsConfig.Certificates = []tls.Certificate{*cfg.TLSCertificate}
+		return tlsConfig, nil
+	}
+
+	reloader, err := newCertificateReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.GetCertificate = reloader.GetCertificate
+
+	return tlsConfig, nil
+}
+
+// clientCAs returns the pool of CAs to verify client certificates against, or nil if client certificates are disabled
+func (cfg *Config) clientCAs() (*x509.CertPool, error) {
+	if cfg.TLSClientCAs != nil {
+		return cfg.TLSClientCAs, nil
+	}
+	if cfg.TLSClientCAFile == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	bundle, err := os.ReadFile(cfg.TLSClientCAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read tls client ca file")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("no certificates found in tls client ca file")
+	}
+
+	return pool, nil
+}
+
+// clientIdentity returns the identity of the client if it presented a verified certificate which is in the
+// allowed clients list, or an empty string otherwise.
+func (cfg *Config) clientIdentity(conn net.Conn) string {
+	state := connectionState(conn)
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	leaf := state.VerifiedChains[0][0]
+
+	identity := cfg.certificateIdentity(leaf)
+	if identity == "" {
+		log.Warn().Strs("client_names", certificateNames(leaf)).Str("remote", conn.RemoteAddr().String()).Msg("client certificate has no name which is allowed to identify the client")
+	}
+	return identity
+}
+
+// certificateIdentity returns the first of the certificate's names which is in the allowed clients list, or if there
+// is no allow list, its first name; an empty string means the certificate isn't allowed.
+func (cfg *Config) certificateIdentity(cert *x509.Certificate) string {
+	names := certificateNames(cert)
+
+	// If no allow list is configured, any certificate signed by one of the client CAs is allowed
+	if len(cfg.TLSAllowedClients) == 0 {
+		if len(names) == 0 {
+			return ""
+		}
+		return names[0]
+	}
+	for _, allowed := range cfg.TLSAllowedClients {
+		for _, name := range names {
+			if allowed == name {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// certificateNames returns the names the certificate identifies the client by; the subject common name if it has one,
+// followed by its DNS, URI and email SANs
+func certificateNames(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	names = append(names, cert.EmailAddresses...)
+	return names
+}
+
+// connectionState finds the TLS state of the connection, looking through any wrappers around the TLS connection
+func connectionState(conn net.Conn) *tls.ConnectionState {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			state := c.ConnectionState()
+			return &state
+		case interface{ UnderlyingConn() net.Conn }:
+			conn = c.UnderlyingConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// certificateReloader serves a certificate from disk, reloading it when the files on disk change.
+type certificateReloader struct {
+	certFile      string
+	keyFile       string
+	checkInterval time.Duration
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+}
+
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{
+		certFile:      certFile,
+		keyFile:       keyFile,
+		checkInterval: CertificateCheckInterval,
+	}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, first reloading it from disk if it has changed
+func (r *certificateReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastCheck) >= r.checkInterval {
+		if err := r.reload(); err != nil {
+			// Keep serving the last good certificate until the files on disk are fixed
+			log.Err(err).Str("cert_file", r.certFile).Msg("unable to reload tls certificate")
+		}
+	}
+
+	return r.cert, nil
+}
+
+// reload loads the certificate from disk if either file has been modified since it was last loaded
+func (r *certificateReloader) reload() error {
+	r.lastCheck = time.Now()
+
+	certStat, err := os.Stat(r.certFile)
+	if err != nil {
+		return errors.Wrap(err, "unable to stat tls certificate file")
+	}
+	keyStat, err := os.Stat(r.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "unable to stat tls key file")
+	}
+
+	if r.cert != nil && certStat.ModTime().Equal(r.certMod) && keyStat.ModTime().Equal(r.keyMod) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "unable to load tls certificate")
+	}
+
+	if r.cert != nil {
+		log.Info().Str("cert_file", r.certFile).Msg("reloaded tls certificate")
+	}
+
+	r.cert = &cert
+	r.certMod = certStat.ModTime()
+	r.keyMod = keyStat.ModTime()
+	return nil
+}
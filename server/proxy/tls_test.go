@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertificateReloader(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+
+	writeCertificate(t, certFile, keyFile, "first", time.Now().Add(-time.Minute))
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("unable to create reloader: %v", err)
+	}
+	reloader.checkInterval = 0
+
+	if name := servedCommonName(t, reloader); name != "first" {
+		t.Fatalf("expected first certificate, got: %s", name)
+	}
+
+	// Replacing the files on disk should result in the new certificate being served
+	writeCertificate(t, certFile, keyFile, "second", time.Now())
+	if name := servedCommonName(t, reloader); name != "second" {
+		t.Fatalf("expected second certificate, got: %s", name)
+	}
+
+	// If the new files are invalid, we keep serving the last good certificate
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("unable to write certificate: %v", err)
+	}
+	if name := servedCommonName(t, reloader); name != "second" {
+		t.Fatalf("expected second certificate to still be served, got: %s", name)
+	}
+}
+
+func TestConfig_CertificateIdentity(t *testing.T) {
+	t.Parallel()
+
+	spiffe, _ := url.Parse("spiffe://example.com/ci")
+	certs := map[string]*x509.Certificate{
+		"cn":       {Subject: pkix.Name{CommonName: "ci.example.com"}, DNSNames: []string{"ci.internal.example.com"}},
+		"dns san":  {DNSNames: []string{"ci.internal.example.com", "ci.example.com"}},
+		"uri san":  {URIs: []*url.URL{spiffe}},
+		"email":    {EmailAddresses: []string{"ci@example.com"}},
+		"no names": {},
+	}
+
+	tests := []struct {
+		name     string
+		cert     string
+		allowed  []string
+		identity string
+	}{
+		{name: "common name", cert: "cn", identity: "ci.example.com"},
+		{name: "dns san only", cert: "dns san", identity: "ci.internal.example.com"},
+		{name: "uri san only", cert: "uri san", identity: "spiffe://example.com/ci"},
+		{name: "email san only", cert: "email", identity: "ci@example.com"},
+		{name: "no names", cert: "no names", identity: ""},
+		{name: "allowed common name", cert: "cn", allowed: []string{"ci.example.com"}, identity: "ci.example.com"},
+		{name: "allowed dns san", cert: "cn", allowed: []string{"ci.internal.example.com"}, identity: "ci.internal.example.com"},
+		{name: "allowed second dns san", cert: "dns san", allowed: []string{"ci.example.com"}, identity: "ci.example.com"},
+		{name: "allowed uri san", cert: "uri san", allowed: []string{"spiffe://example.com/ci"}, identity: "spiffe://example.com/ci"},
+		{name: "not allowed", cert: "dns san", allowed: []string{"deploy.example.com"}, identity: ""},
+		{name: "empty common name not allowed", cert: "dns san", allowed: []string{""}, identity: ""},
+	}
+
+	for _, test := range tests {
+		cfg := &Config{TLSAllowedClients: test.allowed}
+		if identity := cfg.certificateIdentity(certs[test.cert]); identity != test.identity {
+			t.Errorf("%s: expected identity %q, got %q", test.name, test.identity, identity)
+		}
+	}
+}
+
+func servedCommonName(t *testing.T, reloader *certificateReloader) string {
+	t.Helper()
+
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("unable to get certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("unable to parse certificate: %v", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func writeCertificate(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to marshal key: %v", err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("unable to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("unable to write key: %v", err)
+	}
+
+	// Set the modification times explicitly, as the filesystem may not have a fine enough resolution to notice the change
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatalf("unable to set modification time: %v", err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/armon/go-socks5"
+	"github.com/cockroachdb/errors"
+	"go.encore.dev/emissary/internal/emissaryproto"
+)
+
+// serveUDPAssociate tunnels datagrams between a session stream and a UDP target, once the target has been allowed
+func (cfg *Config) serveUDPAssociate(stream net.Conn, t *tunnel) error {
+	// Closing the stream tells the client why it was rejected, if it was
+	conn := &tunnelConn{Conn: stream, tunnel: t}
+	defer func() { _ = conn.Close() }()
+
+	host, port, err := emissaryproto.ReadUDPAssociate(conn)
+	if err != nil {
+		return errors.Wrap(err, "unable to read udp associate request")
+	}
+	t.mu.Lock()
+	t.event.Network = "udp"
+	t.mu.Unlock()
+
+	// Resolve the target, so the rules can check the IP we're about to send to
+	ctx := context.Background()
+	dest := &socks5.AddrSpec{IP: net.ParseIP(host), Port: port}
+	if dest.IP == nil {
+		dest.FQDN = host
+		ctx, dest.IP, err = cfg.resolver(t).Resolve(ctx, host)
+		if err != nil {
+			return rejectUDPAssociate(conn, errors.Wrapf(err, "unable to resolve %s", host))
+		}
+	}
+
+	req := &socks5.Request{
+		Command:    socks5.AssociateCommand,
+		DestAddr:   dest,
+		RemoteAddr: &socks5.AddrSpec{},
+	}
+	if client, ok := stream.RemoteAddr().(*net.TCPAddr); ok {
+		req.RemoteAddr = &socks5.AddrSpec{IP: client.IP, Port: client.Port}
+	}
+	ctx, allowed := scopedRules{cfg: cfg, principal: t.principal, tunnel: t}.Allow(ctx, req)
+	if !allowed {
+		return rejectUDPAssociate(conn, errors.Newf("udp associate to %s blocked by rules", dest))
+	}
+
+	target, err := t.dial(ctx, "udp", net.JoinHostPort(dest.IP.String(), strconv.Itoa(port)))
+	if err != nil {
+		return rejectUDPAssociate(conn, err)
+	}
+	defer func() { _ = target.Close() }()
+
+	if err := emissaryproto.WriteUDPAssociateResult(conn, emissaryproto.UDPAssociateSuccess); err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	// Relay datagrams in both directions until either side fails or the client closes the stream
+	errs := make(chan error, 2)
+	go func() {
+		buf := make([]byte, emissaryproto.MaxDatagramSize)
+		for {
+			n, err := emissaryproto.ReadDatagram(conn, buf)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := target.Write(buf[:n]); err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+				errs <- errors.Wrap(err, "unable to send datagram to target")
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, emissaryproto.MaxDatagramSize)
+		for {
+			n, err := target.Read(buf)
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				// Nothing is listening on the target port yet, which a UDP client would ignore
+				continue
+			}
+			if err != nil {
+				errs <- errors.Wrap(err, "unable to receive datagram from target")
+				return
+			}
+			if err := emissaryproto.WriteDatagram(conn, buf[:n]); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	if err := <-errs; !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// rejectUDPAssociate tells the client its UDP associate request was rejected, returning the reason
+func rejectUDPAssociate(conn net.Conn, reason error) error {
+	if err := emissaryproto.WriteUDPAssociateResult(conn, emissaryproto.UDPAssociateFailure); err != nil {
+		return errors.CombineErrors(reason, err)
+	}
+	return reason
+}
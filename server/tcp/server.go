@@ -2,10 +2,12 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"runtime/debug"
 	"strings"
+	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/rs/zerolog"
@@ -13,22 +15,37 @@ import (
 	"go.encore.dev/emissary/server/proxy"
 )
 
-// StartServer starts listening on the given port for TCP connections
-func StartServer(ctx context.Context, cfg *proxy.Config) error {
+// HandshakeTimeout is how long a client has to complete the TLS handshake
+const HandshakeTimeout = 20 * time.Second
+
+// StartServer starts listening on the given port for TCP connections, until the context is cancelled or the
+// drainer starts draining
+func StartServer(ctx context.Context, live *proxy.LiveConfig, drainer *proxy.Drainer) error {
+	cfg := live.Load()
 	if cfg.TcpPort <= 0 {
 		return nil
 	}
-	log.Info().Int("port", cfg.TcpPort).Msg("starting tcp server")
+	tlsConfig, err := cfg.NewTLSConfig()
+	if err != nil {
+		return errors.Wrap(err, "unable to load tls config")
+	}
+	log.Info().Int("port", cfg.TcpPort).Bool("tls", tlsConfig != nil).Msg("starting tcp server")
 
 	var lc net.ListenConfig
 	srv, err := lc.Listen(ctx, "tcp", fmt.Sprintf(":%d", cfg.TcpPort))
 	if err != nil {
 		return errors.Wrap(err, "unable to listen on tcp port")
 	}
+	if tlsConfig != nil {
+		srv = tls.NewListener(srv, tlsConfig)
+	}
 
-	// Close the socket if the context is cancelled
+	// Close the socket if the context is cancelled, or we start draining
 	go func() {
-		<-ctx.Done()
+		select {
+		case <-ctx.Done():
+		case <-drainer.Draining():
+		}
 		log.Warn().Msg("shutting down tcp server")
 		if err := srv.Close(); err != nil {
 			log.Err(err).Msg("error shutting down tcp server")
@@ -41,24 +58,24 @@ func StartServer(ctx context.Context, cfg *proxy.Config) error {
 		if err != nil {
 			select {
 			case <-ctx.Done():
-				if strings.Contains(err.Error(), "use of closed network connection") {
-					return nil
-				}
-
-				return errors.Wrap(err, "unable to accept")
+			case <-drainer.Draining():
 			default:
+				log.Err(err).Msg("unable to accept tcp connection")
+				continue
 			}
 
-			log.Err(err).Msg("unable to accept tcp connection")
-			continue
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return nil
+			}
+			return errors.Wrap(err, "unable to accept")
 		}
 
-		go handleConn(conn, cfg)
+		go handleConn(conn, live, drainer)
 	}
 }
 
 // handleConn handles a TCP connection and recovers from panics
-func handleConn(conn net.Conn, cfg *proxy.Config) {
+func handleConn(conn net.Conn, live *proxy.LiveConfig, drainer *proxy.Drainer) {
 	defer func() {
 		if err := recover(); err != nil {
 			stack := string(debug.Stack())
@@ -77,9 +94,27 @@ func handleConn(conn net.Conn, cfg *proxy.Config) {
 	l := log.With().Str("remote", conn.RemoteAddr().String()).Str("proxy-method", "tcp").Logger()
 	l.Info().Msg("accepting tcp proxy request")
 
-	if err := cfg.ServeConn(conn); err != nil {
+	// Complete the TLS handshake up front, so a client which never finishes it doesn't hold the connection open
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			l.Err(err).Msg("tls handshake failed")
+			_ = conn.Close()
+			return
+		}
+	}
+
+	// Use the config as it is now, so a reload does not affect this connection once it's established
+	defer func() { _ = conn.Close() }()
+	if err := live.Load().ServeConn(conn, proxy.TransportTCP, true, drainer); err != nil {
+		if errors.Is(err, proxy.ErrDraining) {
+			l.Info().Msg("rejected tcp proxy request as the server is draining")
+			return
+		}
 		l.Err(err).Msg("unable to serve socks 5 proxy")
 	}
 
-	l.Info().Msg("websocket proxy connection closed")
+	l.Info().Msg("tcp proxy connection closed")
 }
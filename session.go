@@ -0,0 +1,180 @@
+package emissary
+
+import (
+	golog "log"
+	"net"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+	"github.com/hashicorp/yamux"
+	"github.com/rs/zerolog/log"
+	"go.encore.dev/emissary/internal/emissaryproto"
+	"golang.org/x/net/proxy"
+)
+
+// MaxStreamsPerSession is the number of concurrent streams we will multiplex over a single transport
+// session before the dialer opens another session to the Emissary server.
+const MaxStreamsPerSession = 64
+
+// session is a multiplexed transport session, along with the connect message the server sent when it was opened,
+// which tells us what the server supports.
+type session struct {
+	*yamux.Session
+	connectMessage *emissaryproto.ServerConnect
+
+	mu         sync.Mutex
+	listeners  map[uint32]*listener // the listeners opened within the session, by the ID of their listen stream
+	acceptOnce sync.Once
+}
+
+// sessionPool tracks the multiplexed transport sessions we have open to an Emissary server.
+type sessionPool struct {
+	mu         sync.Mutex
+	sessions   []*session
+	connecting chan struct{} // closed once the session being connected has been added to the pool, nil if none is
+}
+
+// get returns an open session with capacity for another stream, or nil if there is none.
+func (p *sessionPool) get() *session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	open := p.sessions[:0]
+	var found *session
+	for _, session := range p.sessions {
+		if session.IsClosed() {
+			continue
+		}
+		open = append(open, session)
+
+		if found == nil && session.NumStreams() < MaxStreamsPerSession {
+			found = session
+		}
+	}
+	p.sessions = open
+
+	return found
+}
+
+func (p *sessionPool) add(session *session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sessions = append(p.sessions, session)
+}
+
+// startConnect reports if the caller should connect a new session, so concurrent dials share one session rather than
+// each connecting their own. Otherwise it returns a channel which is closed once the session already being connected
+// is ready, after which the pool should be checked again. Callers which connect must call finishConnect.
+func (p *sessionPool) startConnect() (<-chan struct{}, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.connecting != nil {
+		return p.connecting, false
+	}
+	p.connecting = make(chan struct{})
+	return nil, true
+}
+
+// finishConnect wakes any dials waiting for the session being connected.
+func (p *sessionPool) finishConnect() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	close(p.connecting)
+	p.connecting = nil
+}
+
+// remove stops new streams being opened on a session, such as when the server has told us it is going away.
+func (p *sessionPool) remove(session *session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, s := range p.sessions {
+		if s == session {
+			p.sessions = append(p.sessions[:i], p.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// close closes all sessions in the pool, which will close all streams within them.
+func (p *sessionPool) close() error {
+	p.mu.Lock()
+	sessions := p.sessions
+	p.sessions = nil
+	p.mu.Unlock()
+
+	var err error
+	for _, session := range sessions {
+		err = errors.CombineErrors(err, session.Close())
+	}
+	return errors.Wrap(err, "unable to close emissary sessions")
+}
+
+// newSession authenticates the transport layer and starts a multiplexed session over it.
+//
+// If login is nil, then the server is expected to authenticate us by our client certificate.
+func newSession(transportLayer net.Conn, connectMessage *emissaryproto.ServerConnect, login *proxy.Auth) (*session, error) {
+	var date, hmac string
+	if login != nil {
+		date, hmac = login.User, login.Password
+	}
+
+	if err := emissaryproto.WriteSessionAuth(transportLayer, date, hmac); err != nil {
+		return nil, errors.Wrap(err, "unable to send session auth")
+	}
+	status, err := emissaryproto.ReadSessionAuthResult(transportLayer)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to authenticate emissary session")
+	}
+	if err := sessionAuthError(status); err != nil {
+		return nil, errors.Wrap(withClockSkew(err, connectMessage), "unable to authenticate emissary session")
+	}
+
+	yamuxSession, err := yamux.Client(transportLayer, sessionConfig())
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to start emissary session")
+	}
+
+	log.Debug().Str("server", connectMessage.ServerSoftware).
+		Str("server_version", connectMessage.ServerVersion).
+		Bool("compressed", compressed(transportLayer)).
+		Msg("started multiplexed emissary session")
+
+	return &session{Session: yamuxSession, connectMessage: connectMessage}, nil
+}
+
+// compressed reports if the transport layer compresses what it carries, such as a websocket which negotiated
+// permessage-deflate
+func compressed(transportLayer net.Conn) bool {
+	c, ok := transportLayer.(interface{ Compressed() bool })
+	return ok && c.Compressed()
+}
+
+// openStream opens a new stream within the session, which behaves like a fresh transport layer.
+func openStream(session *session) (*sessionStream, error) {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open emissary stream")
+	}
+	return &sessionStream{stream}, nil
+}
+
+func sessionConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	cfg.LogOutput = nil
+	cfg.Logger = golog.New(log.Logger, "", golog.Lshortfile)
+	return cfg
+}
+
+// sessionStream adapts a yamux stream so the SOCKS5 proxy can half close it.
+type sessionStream struct {
+	*yamux.Stream
+}
+
+// CloseWrite closes the stream for writing; yamux streams remain readable until the remote side closes them.
+func (s *sessionStream) CloseWrite() error {
+	return errors.Wrap(s.Stream.Close(), "unable to close stream")
+}
@@ -0,0 +1,184 @@
+package emissary
+
+import (
+	"compress/flate"
+	"crypto/tls"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"go.encore.dev/emissary/internal/ws"
+	"golang.org/x/net/proxy"
+)
+
+// Transport is the layer which carries the Emissary protocol between the Dialer and the Emissary server.
+//
+// Each call to Dial should return a new connection to the Emissary server, ignoring the target network and
+// address which are passed through for information only.
+type Transport interface {
+	proxy.Dialer
+	proxy.ContextDialer
+}
+
+// TransportFactory creates a Transport which will connect to the Emissary server at the given URL.
+type TransportFactory func(server *url.URL) (Transport, error)
+
+var (
+	transportsMu sync.RWMutex
+	transports   = make(map[string]TransportFactory)
+)
+
+// RegisterTransport makes a custom transport available to NewDialer for URLs with the given scheme.
+//
+// If RegisterTransport is called twice with the same scheme, or with the scheme of a built-in transport, it panics.
+func RegisterTransport(scheme string, factory TransportFactory) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	if factory == nil {
+		panic("emissary: RegisterTransport factory is nil")
+	}
+	if isBuiltinScheme(scheme) {
+		panic("emissary: RegisterTransport called for built-in scheme " + scheme)
+	}
+	if _, dup := transports[scheme]; dup {
+		panic("emissary: RegisterTransport called twice for scheme " + scheme)
+	}
+	transports[scheme] = factory
+}
+
+// Option configures a Dialer created by NewDialer.
+type Option func(*options)
+
+type options struct {
+	tlsConfig        *tls.Config
+	writeOptions     ws.WriteOptions
+	compress         bool // if WithCompression was given, as any flate level, even flate.NoCompression, is valid
+	compressionLevel int
+}
+
+// WithTLSConfig sets the TLS configuration used by the `wss://` and `tls://` transports.
+//
+// If the TLS configuration contains a client certificate which the Emissary server trusts, then the
+// dialer may be created with an empty Key, and the certificate will be used to authenticate instead.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = config
+	}
+}
+
+// WithWriteCoalescing makes the websocket transports hold each write for up to the delay, so small writes made within
+// it are sent to the Emissary server as one websocket message rather than one message each. This suits chatty
+// protocols, at the cost of the delay being added to each round trip.
+func WithWriteCoalescing(delay time.Duration) Option {
+	return func(o *options) {
+		o.writeOptions.FlushDelay = delay
+	}
+}
+
+// WithMaxFrameSize makes the websocket transports split writes larger than size bytes into many websocket messages,
+// rather than sending each write as a single message however large it is.
+func WithMaxFrameSize(size int) Option {
+	return func(o *options) {
+		o.writeOptions.MaxFrameSize = size
+	}
+}
+
+// WithCompression makes the websocket transports ask the Emissary server to compress websocket messages using
+// permessage-deflate, which it does if it's also configured to. Messages we send are compressed at the flate level,
+// which must be from flate.HuffmanOnly (-2) to flate.BestCompression (9); flate.DefaultCompression (-1) balances speed
+// against size, while flate.NoCompression (0) still negotiates permessage-deflate but sends messages uncompressed.
+//
+// Without this option, compression is never asked for.
+//
+// Compression only helps traffic which isn't already compressed or encrypted, and otherwise just costs CPU.
+func WithCompression(level int) Option {
+	return func(o *options) {
+		o.compress = true
+		o.compressionLevel = level
+	}
+}
+
+// NewDialer creates a dialer which will connect to the Emissary server at the given URL, picking the
+// transport layer based on the scheme of the URL:
+//
+//	ws://host:port/path  - a websocket
+//	wss://host:port/path - a websocket over TLS
+//	tcp://host:port      - a raw TCP connection
+//	tls://host:port      - a raw TCP connection over TLS
+//
+// Any other scheme must have been registered using RegisterTransport.
+func NewDialer(server string, key Key, opts ...Option) (*Dialer, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse emissary server url")
+	}
+
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.compress && (o.compressionLevel < flate.HuffmanOnly || o.compressionLevel > flate.BestCompression) {
+		return nil, errors.Newf("invalid compression level %d, expected %d to %d", o.compressionLevel, flate.HuffmanOnly, flate.BestCompression)
+	}
+
+	transport, err := newTransport(u, o)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Dialer{
+		transportLayer: transport,
+		key:            key,
+	}, nil
+}
+
+func newTransport(u *url.URL, o *options) (Transport, error) {
+	switch u.Scheme {
+	case "ws", "wss":
+		return &websocketDialer{
+			address:          u.String(),
+			tlsConfig:        o.tlsConfig,
+			writeOptions:     o.writeOptions,
+			compress:         o.compress,
+			compressionLevel: o.compressionLevel,
+		}, nil
+
+	case "tcp", "tls":
+		if u.Host == "" || u.Port() == "" {
+			return nil, errors.Newf("emissary %s url must include a host and port: %s", u.Scheme, u.Redacted())
+		}
+
+		transport := &tcpDialer{address: u.Host}
+		if u.Scheme == "tls" {
+			transport.tlsConfig = o.tlsConfig
+			if transport.tlsConfig == nil {
+				transport.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+			}
+		}
+		return transport, nil
+	}
+
+	transportsMu.RLock()
+	factory, found := transports[u.Scheme]
+	transportsMu.RUnlock()
+	if !found {
+		return nil, errors.Newf("unknown emissary transport scheme: %q", u.Scheme)
+	}
+
+	transport, err := factory(u)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to create %s transport", u.Scheme)
+	}
+	return transport, nil
+}
+
+func isBuiltinScheme(scheme string) bool {
+	switch scheme {
+	case "ws", "wss", "tcp", "tls":
+		return true
+	default:
+		return false
+	}
+}
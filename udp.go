@@ -0,0 +1,99 @@
+package emissary
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"go.encore.dev/emissary/internal/emissaryproto"
+)
+
+func isUDP(network string) bool {
+	return network == "udp" || network == "udp4" || network == "udp6"
+}
+
+// dialUDP asks the Emissary server to tunnel datagrams to the target address over a stream within a session.
+func dialUDP(ctx context.Context, addr string, stream net.Conn) (net.Conn, error) {
+	host, port, err := splitTargetAddr(addr)
+	if err == nil && port == 0 {
+		err = errors.New("no port given")
+	}
+	if err != nil {
+		_ = stream.Close()
+		return nil, errors.Wrap(err, "invalid udp address")
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	if err := emissaryproto.WriteUDPAssociate(stream, host, port); err != nil {
+		_ = stream.Close()
+		return nil, err //nolint:wrapcheck
+	}
+	result, err := emissaryproto.ReadUDPAssociateResult(stream)
+	if err != nil {
+		_ = stream.Close()
+		return nil, err //nolint:wrapcheck
+	}
+	if result != emissaryproto.UDPAssociateSuccess {
+		err := readHandshakeError(ctx, stream)
+		if err == nil {
+			err = errors.New("emissary server rejected the udp associate request")
+		}
+		_ = stream.Close()
+		return nil, errors.Wrap(err, "unable to dial udp target")
+	}
+	_ = stream.SetDeadline(time.Time{})
+
+	remote := net.Addr(&targetAddr{network: "udp", addr: addr})
+	if ip := net.ParseIP(host); ip != nil {
+		remote = &net.UDPAddr{IP: ip, Port: port}
+	}
+	return &udpConn{Conn: stream, remote: remote}, nil
+}
+
+// udpConn sends and receives datagrams to a single target through an Emissary stream, behaving like a connected
+// UDP socket. It can also be used as a net.PacketConn, so long as it's only used with the target address.
+type udpConn struct {
+	net.Conn
+	remote net.Addr
+
+	r sync.Mutex // held while reading a datagram, so concurrent reads don't interleave
+}
+
+var (
+	_ net.Conn       = (*udpConn)(nil)
+	_ net.PacketConn = (*udpConn)(nil)
+)
+
+func (u *udpConn) Read(p []byte) (int, error) {
+	u.r.Lock()
+	defer u.r.Unlock()
+
+	return emissaryproto.ReadDatagram(u.Conn, p) //nolint:wrapcheck
+}
+
+func (u *udpConn) Write(p []byte) (int, error) {
+	if err := emissaryproto.WriteDatagram(u.Conn, p); err != nil {
+		return 0, err //nolint:wrapcheck
+	}
+	return len(p), nil
+}
+
+func (u *udpConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := u.Read(p)
+	return n, u.remote, err
+}
+
+func (u *udpConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if addr.String() != u.remote.String() {
+		return 0, errors.Newf("udp connection can only send to %s, not %s", u.remote, addr)
+	}
+	return u.Write(p)
+}
+
+func (u *udpConn) RemoteAddr() net.Addr {
+	return u.remote
+}